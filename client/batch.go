@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	rpc "sharding/rpc/hello/v1"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type increaseResult struct {
+	res *rpc.IncreaseResponse
+	err error
+}
+
+type batchItem struct {
+	ctx        context.Context
+	req        *rpc.IncreaseRequest
+	resultChan chan increaseResult
+}
+
+// batch is the pending requests of a node
+type batch struct {
+	conn  *grpc.ClientConn
+	items []*batchItem
+}
+
+// batcher coalesces concurrent Increase requests per node into BatchIncrease calls
+type batcher struct {
+	window  time.Duration
+	maxSize int
+
+	mut     sync.Mutex
+	pending map[*grpc.ClientConn]*batch
+}
+
+func newBatcher(window time.Duration, maxSize int) *batcher {
+	return &batcher{
+		window:  window,
+		maxSize: maxSize,
+		pending: make(map[*grpc.ClientConn]*batch),
+	}
+}
+
+func contextStatusError(ctx context.Context) error {
+	if ctx.Err() == context.Canceled {
+		return status.Error(codes.Canceled, ctx.Err().Error())
+	}
+	return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+}
+
+// increase adds the request into the pending batch of the node, the batch is sent
+// after the window or when it is full
+func (b *batcher) increase(ctx context.Context, conn *grpc.ClientConn, req *rpc.IncreaseRequest,
+) (*rpc.IncreaseResponse, error) {
+	item := &batchItem{
+		ctx:        ctx,
+		req:        req,
+		resultChan: make(chan increaseResult, 1),
+	}
+
+	b.mut.Lock()
+	bt, existed := b.pending[conn]
+	if !existed {
+		bt = &batch{conn: conn}
+		b.pending[conn] = bt
+		time.AfterFunc(b.window, func() {
+			b.flush(bt)
+		})
+	}
+	bt.items = append(bt.items, item)
+
+	full := len(bt.items) >= b.maxSize
+	if full {
+		delete(b.pending, conn)
+	}
+	b.mut.Unlock()
+
+	if full {
+		go b.send(bt)
+	}
+
+	select {
+	case r := <-item.resultChan:
+		return r.res, r.err
+	case <-ctx.Done():
+		return nil, contextStatusError(ctx)
+	}
+}
+
+// flush sends the batch if it was not sent because of being full
+func (b *batcher) flush(bt *batch) {
+	b.mut.Lock()
+	if b.pending[bt.conn] != bt {
+		b.mut.Unlock()
+		return
+	}
+	delete(b.pending, bt.conn)
+	b.mut.Unlock()
+
+	b.send(bt)
+}
+
+// batchContext has the latest deadline of the items, no deadline if any item has none
+func batchContext(items []*batchItem) (context.Context, context.CancelFunc) {
+	var latest time.Time
+	for _, item := range items {
+		deadline, ok := item.ctx.Deadline()
+		if !ok {
+			return context.WithCancel(context.Background())
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return context.WithDeadline(context.Background(), latest)
+}
+
+func (b *batcher) send(bt *batch) {
+	// requests already canceled by their callers are not sent
+	items := make([]*batchItem, 0, len(bt.items))
+	reqs := make([]*rpc.IncreaseRequest, 0, len(bt.items))
+	for _, item := range bt.items {
+		if item.ctx.Err() != nil {
+			continue
+		}
+		items = append(items, item)
+		reqs = append(reqs, item.req)
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	ctx, cancel := batchContext(items)
+	defer cancel()
+
+	client := rpc.NewHelloClient(bt.conn)
+	res, err := client.BatchIncrease(ctx, &rpc.BatchIncreaseRequest{
+		Requests: reqs,
+	})
+	if err == nil && len(res.Results) != len(items) {
+		err = status.Error(codes.Internal, "mismatched number of batch results")
+	}
+	if err != nil {
+		for _, item := range items {
+			item.resultChan <- increaseResult{err: err}
+		}
+		return
+	}
+
+	for i, r := range res.Results {
+		code := codes.Code(r.Code)
+		if code != codes.OK {
+			items[i].resultChan <- increaseResult{err: status.Error(code, r.Message)}
+			continue
+		}
+		items[i].resultChan <- increaseResult{res: &rpc.IncreaseResponse{Value: r.Value}}
+	}
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"net"
+	rpc "sharding/rpc/hello/v1"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeHelloServer replies the counter ids as values
+type fakeHelloServer struct {
+	rpc.UnimplementedHelloServer
+
+	mut     sync.Mutex
+	batches [][]uint32
+	// extraResults are appended to the results of BatchIncrease
+	extraResults int
+}
+
+func (s *fakeHelloServer) BatchIncrease(ctx context.Context, req *rpc.BatchIncreaseRequest,
+) (*rpc.BatchIncreaseResponse, error) {
+	var counters []uint32
+	var results []*rpc.BatchIncreaseResult
+	for _, r := range req.Requests {
+		counters = append(counters, r.Counter)
+		results = append(results, &rpc.BatchIncreaseResult{Value: r.Counter})
+	}
+	for i := 0; i < s.extraResults; i++ {
+		results = append(results, &rpc.BatchIncreaseResult{})
+	}
+
+	s.mut.Lock()
+	s.batches = append(s.batches, counters)
+	s.mut.Unlock()
+
+	return &rpc.BatchIncreaseResponse{Results: results}, nil
+}
+
+func (s *fakeHelloServer) getBatches() [][]uint32 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.batches
+}
+
+// newTestConn serves the server in memory, the connection is closed by the returned function
+func newTestConn(t testing.TB, srv rpc.HelloServer) (*grpc.ClientConn, func()) {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	rpc.RegisterHelloServer(s, srv)
+	go func() { _ = s.Serve(lis) }()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	assert.Equal(t, nil, err)
+
+	return conn, func() {
+		_ = conn.Close()
+		s.Stop()
+	}
+}
+
+func increaseConcurrently(b *batcher, conn *grpc.ClientConn, counters ...uint32) []uint32 {
+	values := make([]uint32, len(counters))
+	var wg sync.WaitGroup
+	wg.Add(len(counters))
+	for i, counter := range counters {
+		index := i
+		req := &rpc.IncreaseRequest{Counter: counter}
+		go func() {
+			defer wg.Done()
+			res, err := b.increase(context.Background(), conn, req)
+			if err == nil {
+				values[index] = res.Value
+			}
+		}()
+	}
+	wg.Wait()
+	return values
+}
+
+func TestBatcher_Flush(t *testing.T) {
+	t.Run("window", func(t *testing.T) {
+		srv := &fakeHelloServer{}
+		conn, closeConn := newTestConn(t, srv)
+		defer closeConn()
+
+		b := newBatcher(20*time.Millisecond, 10)
+		values := increaseConcurrently(b, conn, 10, 11, 12)
+
+		assert.Equal(t, []uint32{10, 11, 12}, values)
+		assert.Equal(t, 1, len(srv.getBatches()))
+		assert.Equal(t, 3, len(srv.getBatches()[0]))
+	})
+
+	t.Run("full", func(t *testing.T) {
+		srv := &fakeHelloServer{}
+		conn, closeConn := newTestConn(t, srv)
+		defer closeConn()
+
+		// sent without waiting for the window
+		b := newBatcher(time.Hour, 2)
+		values := increaseConcurrently(b, conn, 10, 11)
+
+		assert.Equal(t, []uint32{10, 11}, values)
+		assert.Equal(t, 1, len(srv.getBatches()))
+	})
+}
+
+func TestBatcher_Send(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	newItem := func(ctx context.Context, counter uint32) *batchItem {
+		return &batchItem{
+			ctx:        ctx,
+			req:        &rpc.IncreaseRequest{Counter: counter},
+			resultChan: make(chan increaseResult, 1),
+		}
+	}
+
+	t.Run("canceled-items", func(t *testing.T) {
+		srv := &fakeHelloServer{}
+		conn, closeConn := newTestConn(t, srv)
+		defer closeConn()
+
+		item := newItem(context.Background(), 11)
+		b := newBatcher(time.Hour, 10)
+		b.send(&batch{
+			conn:  conn,
+			items: []*batchItem{newItem(canceled, 10), item},
+		})
+
+		assert.Equal(t, [][]uint32{{11}}, srv.getBatches())
+		assert.Equal(t, increaseResult{res: &rpc.IncreaseResponse{Value: 11}}, <-item.resultChan)
+	})
+
+	t.Run("mismatched-results", func(t *testing.T) {
+		srv := &fakeHelloServer{extraResults: 1}
+		conn, closeConn := newTestConn(t, srv)
+		defer closeConn()
+
+		items := []*batchItem{newItem(context.Background(), 10), newItem(context.Background(), 11)}
+		b := newBatcher(time.Hour, 10)
+		b.send(&batch{conn: conn, items: items})
+
+		for _, item := range items {
+			r := <-item.resultChan
+			assert.Equal(t, codes.Internal, status.Code(r.err))
+		}
+	})
+}
+
+func TestBatchContext(t *testing.T) {
+	now := time.Now()
+
+	newItem := func(timeout time.Duration) *batchItem {
+		if timeout == 0 {
+			return &batchItem{ctx: context.Background()}
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), now.Add(timeout))
+		t.Cleanup(cancel)
+		return &batchItem{ctx: ctx}
+	}
+
+	table := []struct {
+		name     string
+		timeouts []time.Duration
+		// zero for no deadline
+		deadline time.Duration
+	}{
+		{
+			name:     "latest",
+			timeouts: []time.Duration{time.Second, 3 * time.Second, 2 * time.Second},
+			deadline: 3 * time.Second,
+		},
+		{
+			name:     "no-deadline",
+			timeouts: []time.Duration{time.Second, 0},
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			var items []*batchItem
+			for _, timeout := range e.timeouts {
+				items = append(items, newItem(timeout))
+			}
+
+			ctx, cancel := batchContext(items)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			assert.Equal(t, e.deadline != 0, ok)
+			if ok {
+				assert.Equal(t, now.Add(e.deadline), deadline)
+			}
+		})
+	}
+}
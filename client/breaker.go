@@ -0,0 +1,204 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BreakerPolicy configures circuit breakers per node address
+type BreakerPolicy struct {
+	// ConsecutiveFailures opens the breaker, zero for disabled
+	ConsecutiveFailures int
+	// ErrorRate of the window opens the breaker after MinRequests, zero for disabled
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	// OpenDuration is the time failing fast before probing the node again
+	OpenDuration time.Duration
+	// HalfOpenProbes is the number of concurrent probes, the breaker is closed
+	// after that many succeeded
+	HalfOpenProbes int
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var errCircuitOpen = status.Error(codes.Unavailable, "Circuit breaker open")
+
+// breaker tracks failures of a node, fails fast when the node looks unhealthy
+type breaker struct {
+	policy BreakerPolicy
+
+	mut   sync.Mutex
+	state breakerState
+
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	openedAt  time.Time
+	probes    int
+	successes int
+}
+
+func newBreaker(policy BreakerPolicy) *breaker {
+	if policy.HalfOpenProbes < 1 {
+		policy.HalfOpenProbes = 1
+	}
+	return &breaker{
+		policy: policy,
+	}
+}
+
+// allow returns false if the node must not be called, done must be called if allowed
+func (b *breaker) allow(now time.Time) bool {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.policy.OpenDuration {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probes = 0
+		b.successes = 0
+		fallthrough
+
+	case breakerHalfOpen:
+		if b.probes >= b.policy.HalfOpenProbes {
+			return false
+		}
+		b.probes++
+		return true
+
+	default:
+		return true
+	}
+}
+
+// done records the result of an allowed call, ignored results only release probes,
+// returns true if the breaker was opened
+func (b *breaker) done(now time.Time, failed bool, ignored bool) bool {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probes--
+		if ignored {
+			return false
+		}
+		if failed {
+			b.open(now)
+			return true
+		}
+
+		b.successes++
+		if b.successes >= b.policy.HalfOpenProbes {
+			b.reset(now)
+		}
+		return false
+	}
+
+	if b.state == breakerOpen || ignored {
+		return false
+	}
+
+	if now.Sub(b.windowStart) >= b.policy.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return false
+	}
+	b.failures++
+	b.consecutive++
+
+	if b.policy.ConsecutiveFailures > 0 && b.consecutive >= b.policy.ConsecutiveFailures {
+		b.open(now)
+		return true
+	}
+
+	if b.policy.ErrorRate > 0 && b.requests >= b.policy.MinRequests &&
+		float64(b.failures) >= b.policy.ErrorRate*float64(b.requests) {
+		b.open(now)
+		return true
+	}
+	return false
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+}
+
+func (b *breaker) reset(now time.Time) {
+	b.state = breakerClosed
+	b.consecutive = 0
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+// breakers keeps a breaker per node address
+type breakers struct {
+	policy BreakerPolicy
+
+	mut sync.Mutex
+	m   map[string]*breaker
+}
+
+func newBreakers(policy BreakerPolicy) *breakers {
+	return &breakers{
+		policy: policy,
+		m:      make(map[string]*breaker),
+	}
+}
+
+func (bs *breakers) get(address string) *breaker {
+	bs.mut.Lock()
+	defer bs.mut.Unlock()
+
+	b, ok := bs.m[address]
+	if !ok {
+		b = newBreaker(bs.policy)
+		bs.m[address] = b
+	}
+	return b
+}
+
+// retain removes breakers of removed nodes
+func (bs *breakers) retain(addresses map[string]struct{}) {
+	bs.mut.Lock()
+	defer bs.mut.Unlock()
+
+	for address := range bs.m {
+		if _, ok := addresses[address]; !ok {
+			delete(bs.m, address)
+		}
+	}
+}
+
+// isNodeFailure returns true for errors caused by an unhealthy node,
+// not by the ring changing, overloading or the request itself
+func isNodeFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker_ConsecutiveFailures(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreaker(BreakerPolicy{
+		ConsecutiveFailures: 2,
+		Window:              time.Minute,
+		OpenDuration:        5 * time.Second,
+	})
+
+	assert.Equal(t, true, b.allow(now))
+	assert.Equal(t, false, b.done(now, true, false))
+	assert.Equal(t, false, b.done(now, false, false))
+	assert.Equal(t, false, b.done(now, true, false))
+	assert.Equal(t, true, b.done(now, true, false))
+
+	// fails fast until the open duration passed
+	assert.Equal(t, false, b.allow(now.Add(4*time.Second)))
+
+	// only one probe when half open
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, true, b.allow(now))
+	assert.Equal(t, false, b.allow(now))
+
+	// opened again if the probe failed
+	assert.Equal(t, true, b.done(now, true, false))
+	assert.Equal(t, false, b.allow(now))
+
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, true, b.allow(now))
+	assert.Equal(t, false, b.done(now, false, false))
+	assert.Equal(t, breakerClosed, b.state)
+	assert.Equal(t, true, b.allow(now))
+}
+
+func TestBreaker_ErrorRate(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreaker(BreakerPolicy{
+		ErrorRate:    0.5,
+		MinRequests:  4,
+		Window:       time.Minute,
+		OpenDuration: 5 * time.Second,
+	})
+
+	assert.Equal(t, false, b.done(now, true, false))
+	assert.Equal(t, false, b.done(now, false, false))
+	assert.Equal(t, false, b.done(now, false, false))
+
+	// ignored results are not counted
+	assert.Equal(t, false, b.done(now, true, true))
+	assert.Equal(t, true, b.done(now, true, false))
+
+	// failures of a previous window are forgotten
+	b = newBreaker(b.policy)
+	assert.Equal(t, false, b.done(now, true, false))
+	assert.Equal(t, false, b.done(now, true, false))
+	assert.Equal(t, false, b.done(now, false, false))
+	assert.Equal(t, false, b.done(now.Add(time.Minute), true, false))
+	assert.Equal(t, breakerClosed, b.state)
+}
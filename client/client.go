@@ -0,0 +1,343 @@
+// Package client routes requests directly to the owner nodes of counters
+// using its own view of the consistent hashing ring.
+package client
+
+import (
+	"context"
+	"errors"
+	"sharding/core"
+	"sharding/domain/hello"
+	rpc "sharding/rpc/hello/v1"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errNoRoute = errors.New("no route to the owner node")
+
+// Client calls the owner node of a counter, retries when the ring is changing
+type Client struct {
+	router   *Router
+	policy   RetryPolicy
+	throttle *retryThrottle
+	logger   *zap.Logger
+
+	// batcher is nil if batching is disabled
+	batcher *batcher
+	// streams is nil if streaming is disabled
+	streams *streamMux
+	// breakers is nil if circuit breakers are disabled
+	breakers *breakers
+	// hedger is nil if hedging is disabled
+	hedger *hedger
+}
+
+// New creates a Client without any nodes, nodes are set by Watch or Start
+func New(opts ConnOptions) *Client {
+	return &Client{
+		router: NewRouter(opts),
+		policy: DefaultRetryPolicy(),
+		logger: zap.NewNop(),
+	}
+}
+
+// SetRetryPolicy replaces DefaultRetryPolicy, must be called before any requests
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.policy = policy
+	c.throttle = newRetryThrottle(policy.ThrottleMaxTokens, policy.ThrottleTokenRatio)
+}
+
+// SetLogger sets the logger of retries, nothing is logged by default
+func (c *Client) SetLogger(logger *zap.Logger) {
+	c.logger = logger
+}
+
+// EnableBatching coalesces concurrent Increase requests per node over the window
+// into BatchIncrease calls of at most maxSize requests, must be called before any requests
+func (c *Client) EnableBatching(window time.Duration, maxSize int) {
+	c.batcher = newBatcher(window, maxSize)
+}
+
+// EnableStreaming multiplexes Increase requests per node over one StreamIncrease stream,
+// takes precedence over batching, must be called before any requests
+func (c *Client) EnableStreaming() {
+	c.streams = newStreamMux()
+}
+
+// EnableCircuitBreaker fails fast with Unavailable when calling unhealthy nodes,
+// must be called before any requests
+func (c *Client) EnableCircuitBreaker(policy BreakerPolicy) {
+	c.breakers = newBreakers(policy)
+}
+
+// EnableHedging sends stale reads to the next node of the ring when the owner
+// does not reply in time, must be called before any requests
+func (c *Client) EnableHedging(policy HedgePolicy) {
+	c.hedger = newHedger(policy)
+}
+
+// Watch updates the view of the ring
+func (c *Client) Watch(nodes []core.NodeInfo) {
+	c.router.Watch(nodes)
+
+	if c.breakers != nil {
+		addresses := make(map[string]struct{}, len(nodes))
+		for _, n := range nodes {
+			addresses[n.Address] = struct{}{}
+		}
+		c.breakers.retain(addresses)
+	}
+}
+
+// Close closes connections to all nodes
+func (c *Client) Close() {
+	c.router.Close()
+}
+
+// Start watches nodes of the ring in background until the context is done,
+// it returns after the first view of the ring was received
+func (c *Client) Start(ctx context.Context, coreService core.Service) error {
+	watchChan := make(chan core.WatchResponse, 1)
+	err := coreService.Watch(ctx, watchChan)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case wr := <-watchChan:
+		c.Watch(wr.Nodes)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	go func() {
+		for {
+			select {
+			case wr := <-watchChan:
+				c.Watch(wr.Nodes)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Increase increases the counter on its owner node
+func (c *Client) Increase(ctx context.Context, req *rpc.IncreaseRequest,
+) (*rpc.IncreaseResponse, error) {
+	hash := core.HashUint32(req.Counter)
+	var res *rpc.IncreaseResponse
+
+	// makes retries safe when the first attempt was actually committed,
+	// the request of the caller is not changed
+	if req.RequestId == "" {
+		req = proto.Clone(req).(*rpc.IncreaseRequest)
+		req.RequestId = uuid.New().String()
+	}
+
+	err := c.call(ctx, hash, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		if c.streams != nil {
+			res, err = c.streams.increase(ctx, conn, req)
+			return err
+		}
+		if c.batcher != nil {
+			res, err = c.batcher.increase(ctx, conn, req)
+			return err
+		}
+
+		client := rpc.NewHelloClient(conn)
+		res, err = client.Increase(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// CheckAndIncrease increases the window counter on its owner node if below the limit
+func (c *Client) CheckAndIncrease(ctx context.Context, req *rpc.CheckAndIncreaseRequest,
+) (*rpc.CheckAndIncreaseResponse, error) {
+	hash := core.HashUint32(req.Counter)
+	var res *rpc.CheckAndIncreaseResponse
+
+	// an allowed attempt must not be counted again by retries
+	if req.RequestId == "" {
+		req = proto.Clone(req).(*rpc.CheckAndIncreaseRequest)
+		req.RequestId = uuid.New().String()
+	}
+
+	err := c.call(ctx, hash, func(ctx context.Context, conn *grpc.ClientConn) error {
+		client := rpc.NewHelloClient(conn)
+
+		var err error
+		res, err = client.CheckAndIncrease(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Get reads the counter on its owner node, reads allowing stale values are hedged if enabled
+func (c *Client) Get(ctx context.Context, req *rpc.GetRequest) (*rpc.GetResponse, error) {
+	if c.hedger != nil && req.AllowStale {
+		return c.hedgedGet(ctx, req)
+	}
+
+	var res *rpc.GetResponse
+	err := c.call(ctx, core.HashUint32(req.Counter), func(ctx context.Context, conn *grpc.ClientConn) error {
+		client := rpc.NewHelloClient(conn)
+
+		var err error
+		res, err = client.Get(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Delete deletes the counter on its owner node
+func (c *Client) Delete(ctx context.Context, req *rpc.DeleteRequest,
+) (*rpc.DeleteResponse, error) {
+	hash := core.HashUint32(req.Counter)
+	var res *rpc.DeleteResponse
+
+	err := c.call(ctx, hash, func(ctx context.Context, conn *grpc.ClientConn) error {
+		client := rpc.NewHelloClient(conn)
+
+		var err error
+		res, err = client.Delete(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// attempt calls fn once on the current owner of the hash
+func (c *Client) attempt(ctx context.Context, hash core.Hash,
+	fn func(ctx context.Context, conn *grpc.ClientConn) error,
+) error {
+	rt, ok := c.router.GetRoute(hash)
+	if !ok {
+		return errNoRoute
+	}
+	defer rt.Release()
+
+	return c.attemptRoute(ctx, rt, fn)
+}
+
+// attemptRoute calls fn once on the node of the route
+func (c *Client) attemptRoute(ctx context.Context, rt Route,
+	fn func(ctx context.Context, conn *grpc.ClientConn) error,
+) error {
+	var b *breaker
+	if c.breakers != nil {
+		b = c.breakers.get(rt.Address)
+		if !b.allow(time.Now()) {
+			return errCircuitOpen
+		}
+	}
+
+	attemptCtx := ctx
+	if c.policy.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, c.policy.AttemptTimeout)
+		defer cancel()
+	}
+
+	err := fn(attemptCtx, rt.Conn)
+	if b != nil {
+		// errors after the caller gave up tell nothing about the node
+		ignored := err != nil && ctx.Err() != nil
+		if b.done(time.Now(), isNodeFailure(err), ignored) {
+			c.logger.Warn("Circuit breaker opened",
+				zap.String("address", rt.Address), zap.Error(err))
+		}
+	}
+	return err
+}
+
+// exhaustedError is returned when no more retries are allowed
+func exhaustedError(err error) error {
+	if err == errNoRoute {
+		return hello.ErrServiceUnavailable
+	}
+
+	code := status.Code(err)
+	if code == codes.Aborted || code == codes.Unavailable {
+		return hello.ErrServiceUnavailable
+	}
+	// lets clients back off when overloaded
+	return err
+}
+
+func (c *Client) call(ctx context.Context, hash core.Hash,
+	fn func(ctx context.Context, conn *grpc.ClientConn) error,
+) error {
+	var budgetDeadline time.Time
+	if c.policy.Budget > 0 {
+		budgetDeadline = time.Now().Add(c.policy.Budget)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := c.attempt(ctx, hash, fn)
+		if err == nil {
+			c.throttle.success()
+			return nil
+		}
+
+		// retrying the same unhealthy node is useless
+		if err == errCircuitOpen {
+			return err
+		}
+
+		// the ring is changing if no route, not a failure of nodes
+		if err != errNoRoute {
+			if !c.policy.retryable(status.Code(err)) {
+				return err
+			}
+			if !c.throttle.failure() {
+				return exhaustedError(err)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return hello.ErrClientAborted
+		}
+
+		if attempt >= c.policy.MaxAttempts {
+			return exhaustedError(err)
+		}
+
+		delay := c.policy.backoff(attempt)
+		if !budgetDeadline.IsZero() && time.Now().Add(delay).After(budgetDeadline) {
+			return exhaustedError(err)
+		}
+
+		c.logger.Debug("Retrying call",
+			zap.Int("attempt", attempt), zap.Duration("backoff", delay), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return hello.ErrClientAborted
+		case <-time.After(delay):
+		}
+	}
+}
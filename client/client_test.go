@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"sharding/core"
+	rpc "sharding/rpc/hello/v1"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIncreaseServer records request ids of Increase and CheckAndIncrease
+type fakeIncreaseServer struct {
+	rpc.UnimplementedHelloServer
+
+	mut        sync.Mutex
+	requestIDs []string
+}
+
+func (s *fakeIncreaseServer) record(requestID string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.requestIDs = append(s.requestIDs, requestID)
+}
+
+func (s *fakeIncreaseServer) getRequestIDs() []string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.requestIDs
+}
+
+func (s *fakeIncreaseServer) Increase(ctx context.Context, req *rpc.IncreaseRequest,
+) (*rpc.IncreaseResponse, error) {
+	s.record(req.RequestId)
+	return &rpc.IncreaseResponse{}, nil
+}
+
+func (s *fakeIncreaseServer) CheckAndIncrease(ctx context.Context, req *rpc.CheckAndIncreaseRequest,
+) (*rpc.CheckAndIncreaseResponse, error) {
+	s.record(req.RequestId)
+	return &rpc.CheckAndIncreaseResponse{}, nil
+}
+
+func TestClient_RequestID(t *testing.T) {
+	srv := &fakeIncreaseServer{}
+	addr, stop := serveHello(t, srv)
+	defer stop()
+
+	c := New(DefaultConnOptions())
+	defer c.Close()
+	c.Watch([]core.NodeInfo{{NodeID: 1, Hash: 100, Address: addr}})
+
+	// the requests are shared by concurrent calls
+	increaseReq := &rpc.IncreaseRequest{Counter: 10}
+	checkReq := &rpc.CheckAndIncreaseRequest{Counter: 10, Limit: 5, WindowMs: 1000}
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			_, err := c.Increase(context.Background(), increaseReq)
+			assert.Equal(t, nil, err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := c.CheckAndIncrease(context.Background(), checkReq)
+			assert.Equal(t, nil, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, "", increaseReq.RequestId)
+	assert.Equal(t, "", checkReq.RequestId)
+
+	// a new id per call
+	seen := make(map[string]struct{})
+	for _, id := range srv.getRequestIDs() {
+		assert.NotEqual(t, "", id)
+		seen[id] = struct{}{}
+	}
+	assert.Equal(t, 4, len(seen))
+
+	// ids of callers are kept
+	_, err := c.Increase(context.Background(), &rpc.IncreaseRequest{Counter: 10, RequestId: "req-1"})
+	assert.Equal(t, nil, err)
+	ids := srv.getRequestIDs()
+	assert.Equal(t, "req-1", ids[len(ids)-1])
+}
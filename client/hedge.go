@@ -0,0 +1,203 @@
+package client
+
+import (
+	"context"
+	"sharding/core"
+	rpc "sharding/rpc/hello/v1"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// HedgePolicy configures hedging stale reads to the next node of the ring
+type HedgePolicy struct {
+	// Percentile of recent read latencies used as the delay before hedging, such as 0.95
+	Percentile float64
+	// InitialDelay is used until enough latencies were observed
+	InitialDelay time.Duration
+	// MinDelay bounds the delay, avoids doubling the load when all reads are fast
+	MinDelay time.Duration
+}
+
+const (
+	// hedgeSamples is the number of recent latencies kept
+	hedgeSamples = 1000
+	// hedgeMinSamples is the number of latencies before replacing the initial delay
+	hedgeMinSamples = 100
+	// hedgeRecomputeInterval is the number of new latencies before recomputing the delay
+	hedgeRecomputeInterval = 100
+)
+
+// hedger computes the delay before hedging from recent latencies
+type hedger struct {
+	policy HedgePolicy
+
+	mut            sync.Mutex
+	samples        []time.Duration
+	next           int
+	sinceRecompute int
+	delay          time.Duration
+}
+
+func newHedger(policy HedgePolicy) *hedger {
+	return &hedger{
+		policy:  policy,
+		samples: make([]time.Duration, 0, hedgeSamples),
+		delay:   policy.InitialDelay,
+	}
+}
+
+func (h *hedger) getDelay() time.Duration {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	return h.delay
+}
+
+func (h *hedger) record(d time.Duration) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, d)
+	} else {
+		h.samples[h.next] = d
+		h.next = (h.next + 1) % hedgeSamples
+	}
+
+	h.sinceRecompute++
+	if len(h.samples) < hedgeMinSamples || h.sinceRecompute < hedgeRecomputeInterval {
+		return
+	}
+	h.sinceRecompute = 0
+
+	h.delay = percentile(h.samples, h.policy.Percentile)
+	if h.delay < h.policy.MinDelay {
+		h.delay = h.policy.MinDelay
+	}
+}
+
+func percentile(samples []time.Duration, p float64) time.Duration {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	index := int(p * float64(len(sorted)-1))
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+type getResult struct {
+	res *rpc.GetResponse
+	err error
+	// primary is true for the result of the owner
+	primary bool
+}
+
+// hedgedGet reads from the owner, also from the next node of the ring if the owner
+// has not replied after the delay, the first succeeded reply wins
+func (c *Client) hedgedGet(ctx context.Context, req *rpc.GetRequest) (*rpc.GetResponse, error) {
+	hash := core.HashUint32(req.Counter)
+
+	// cancels the slower read
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resultChan := make(chan getResult, 2)
+	start := time.Now()
+
+	go func() {
+		var res *rpc.GetResponse
+		err := c.call(ctx, hash, func(ctx context.Context, conn *grpc.ClientConn) error {
+			var err error
+			res, err = rpc.NewHelloClient(conn).Get(ctx, req)
+			return err
+		})
+		resultChan <- getResult{res: res, err: err, primary: true}
+	}()
+
+	timer := time.NewTimer(c.hedger.getDelay())
+	defer timer.Stop()
+
+	pending := 1
+	var primaryErr error
+	for {
+		select {
+		case <-timer.C:
+			if c.hedge(ctx, hash, req, resultChan) {
+				pending++
+			}
+
+		case r := <-resultChan:
+			pending--
+			if r.err == nil {
+				// hedged replies are not latencies of the owner
+				if r.primary {
+					c.hedger.record(time.Since(start))
+				}
+				return r.res, nil
+			}
+
+			if r.primary {
+				primaryErr = r.err
+			}
+			if pending > 0 {
+				continue
+			}
+
+			if primaryErr != nil {
+				return nil, primaryErr
+			}
+			return nil, r.err
+		}
+	}
+}
+
+// hedge sends the read to the next node of the ring with a healthy connection,
+// returns false if no such node
+func (c *Client) hedge(ctx context.Context, hash core.Hash, req *rpc.GetRequest,
+	resultChan chan<- getResult,
+) bool {
+	nodes := c.router.getNodes()
+	nextNodes := core.GetNextNodes(nodes, hash, len(nodes))
+	if len(nextNodes) < 2 {
+		return false
+	}
+
+	// the owner is called by the primary read, even if it is unhealthy
+	owner := nextNodes[0].NodeID
+	for _, node := range nextNodes[1:] {
+		if node.NodeID == owner {
+			continue
+		}
+		rt, ok := c.router.acquireRoute(node)
+		if !ok {
+			continue
+		}
+
+		c.logger.Debug("Hedging read", zap.Uint32("counter", req.Counter), zap.String("address", rt.Address))
+
+		go func() {
+			defer rt.Release()
+
+			var res *rpc.GetResponse
+			err := c.attemptRoute(ctx, rt, func(ctx context.Context, conn *grpc.ClientConn) error {
+				var err error
+				res, err = rpc.NewHelloClient(conn).Get(ctx, req)
+				return err
+			})
+			resultChan <- getResult{res: res, err: err}
+		}()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"math"
+	"net"
+	"sharding/core"
+	rpc "sharding/rpc/hello/v1"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestHedger_Delay(t *testing.T) {
+	h := newHedger(HedgePolicy{
+		Percentile:   0.9,
+		InitialDelay: 10 * time.Millisecond,
+		MinDelay:     2 * time.Millisecond,
+	})
+
+	for i := 0; i < hedgeMinSamples-1; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, 10*time.Millisecond, h.getDelay())
+
+	h.record(99 * time.Millisecond)
+	assert.Equal(t, 89*time.Millisecond, h.getDelay())
+
+	// old latencies are replaced
+	for i := 0; i < hedgeSamples; i++ {
+		h.record(time.Millisecond)
+	}
+	assert.Equal(t, 2*time.Millisecond, h.getDelay())
+}
+
+// fakeGetServer replies the value after the delay
+type fakeGetServer struct {
+	rpc.UnimplementedHelloServer
+	value uint32
+	delay time.Duration
+	// canceled is closed if the read was canceled
+	canceled chan struct{}
+}
+
+func (s *fakeGetServer) Get(ctx context.Context, req *rpc.GetRequest) (*rpc.GetResponse, error) {
+	select {
+	case <-time.After(s.delay):
+		return &rpc.GetResponse{Value: s.value}, nil
+	case <-ctx.Done():
+		close(s.canceled)
+		return nil, ctx.Err()
+	}
+}
+
+// serveHello serves the server on a local port, stopped by the returned function
+func serveHello(t *testing.T, srv rpc.HelloServer) (string, func()) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.Equal(t, nil, err)
+
+	s := grpc.NewServer()
+	rpc.RegisterHelloServer(s, srv)
+	go func() { _ = s.Serve(lis) }()
+	return lis.Addr().String(), s.Stop
+}
+
+func TestClient_HedgedGet(t *testing.T) {
+	const counter = 10
+	hash := core.HashUint32(counter)
+
+	table := []struct {
+		name           string
+		ownerDelay     time.Duration
+		nextDelay      time.Duration
+		ownerUnhealthy bool
+		value          uint32
+		ownerCanceled  bool
+		// samples is the number of latencies recorded
+		samples int
+	}{
+		{
+			name:       "owner-fast",
+			ownerDelay: 0,
+			nextDelay:  time.Second,
+			value:      1,
+			samples:    1,
+		},
+		{
+			name:          "owner-slow",
+			ownerDelay:    time.Second,
+			nextDelay:     0,
+			value:         2,
+			ownerCanceled: true,
+			samples:       0,
+		},
+		{
+			name:           "owner-unhealthy",
+			ownerDelay:     0,
+			nextDelay:      0,
+			ownerUnhealthy: true,
+			value:          2,
+			samples:        0,
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			owner := &fakeGetServer{value: 1, delay: e.ownerDelay, canceled: make(chan struct{})}
+			ownerAddr, stopOwner := serveHello(t, owner)
+			defer stopOwner()
+
+			next := &fakeGetServer{value: 2, delay: e.nextDelay, canceled: make(chan struct{})}
+			nextAddr, stopNext := serveHello(t, next)
+			defer stopNext()
+
+			c := New(DefaultConnOptions())
+			defer c.Close()
+			c.EnableHedging(HedgePolicy{
+				Percentile:   0.95,
+				InitialDelay: 20 * time.Millisecond,
+				MinDelay:     time.Millisecond,
+			})
+			c.Watch([]core.NodeInfo{
+				{NodeID: 1, Hash: hash, Address: ownerAddr},
+				{NodeID: 2, Hash: math.MaxUint32, Address: nextAddr},
+			})
+			if e.ownerUnhealthy {
+				c.router.pool.conns[ownerAddr].healthy = 0
+			}
+
+			res, err := c.Get(context.Background(), &rpc.GetRequest{Counter: counter, AllowStale: true})
+			assert.Equal(t, nil, err)
+			assert.Equal(t, e.value, res.Value)
+			assert.Equal(t, e.samples, len(c.hedger.samples))
+
+			// the slower read is canceled
+			if e.ownerCanceled {
+				select {
+				case <-owner.canceled:
+				case <-time.After(time.Second):
+					t.Fatal("the read of the owner was not canceled")
+				}
+			}
+		})
+	}
+}
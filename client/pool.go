@@ -0,0 +1,252 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// ConnOptions configures connections to nodes
+type ConnOptions struct {
+	// backoff of reconnecting
+	BaseDelay         time.Duration
+	MaxDelay          time.Duration
+	MinConnectTimeout time.Duration
+
+	// keepalive pings, nodes must permit pings at KeepaliveTime, zero for disabled
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+
+	// HealthCheckInterval of the gRPC health checking, zero for disabled
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// CloseTimeout bounds waiting for in-flight calls before closing connections to removed nodes
+	CloseTimeout time.Duration
+
+	Logger *zap.Logger
+}
+
+// DefaultConnOptions keeps the reconnecting backoff of nodes, without health checking
+func DefaultConnOptions() ConnOptions {
+	return ConnOptions{
+		BaseDelay:         5 * time.Second,
+		MaxDelay:          10 * time.Second,
+		MinConnectTimeout: 5 * time.Second,
+		CloseTimeout:      10 * time.Second,
+		Logger:            zap.NewNop(),
+	}
+}
+
+// DialOptions returns options of connections to nodes
+func (o ConnOptions) DialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  o.BaseDelay,
+				Multiplier: 1.6,
+				Jitter:     0.3,
+				MaxDelay:   o.MaxDelay,
+			},
+			MinConnectTimeout: o.MinConnectTimeout,
+		}),
+	}
+
+	if o.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                o.KeepaliveTime,
+			Timeout:             o.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	return opts
+}
+
+// poolConn is a connection with the number of in-flight calls
+type poolConn struct {
+	address string
+	conn    *grpc.ClientConn
+	// healthy is accessed atomically, 1 for healthy
+	healthy int32
+	cancel  context.CancelFunc
+
+	// guarded by the mutex of the pool
+	refs    int
+	removed bool
+
+	closeOnce sync.Once
+}
+
+func (pc *poolConn) isHealthy() bool {
+	return atomic.LoadInt32(&pc.healthy) == 1
+}
+
+// Pool keeps connections to nodes, connections to removed nodes are closed
+// after their in-flight calls finished
+type Pool struct {
+	opts ConnOptions
+
+	mut   sync.Mutex
+	conns map[string]*poolConn
+}
+
+// NewPool creates a Pool without any connections
+func NewPool(opts ConnOptions) *Pool {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	return &Pool{
+		opts:  opts,
+		conns: make(map[string]*poolConn),
+	}
+}
+
+// Update connects to new addresses and gracefully closes connections to removed ones
+func (p *Pool) Update(addresses []string) {
+	addressSet := make(map[string]struct{}, len(addresses))
+	for _, addr := range addresses {
+		addressSet[addr] = struct{}{}
+	}
+
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	for addr, pc := range p.conns {
+		if _, existed := addressSet[addr]; existed {
+			continue
+		}
+		delete(p.conns, addr)
+		p.remove(pc)
+	}
+
+	for addr := range addressSet {
+		if _, existed := p.conns[addr]; existed {
+			continue
+		}
+
+		conn, err := grpc.Dial(addr, p.opts.DialOptions()...)
+		if err != nil {
+			p.opts.Logger.Error("Dial", zap.String("address", addr), zap.Error(err))
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		pc := &poolConn{
+			address: addr,
+			conn:    conn,
+			healthy: 1,
+			cancel:  cancel,
+		}
+		p.conns[addr] = pc
+
+		if p.opts.HealthCheckInterval > 0 {
+			go p.checkHealth(ctx, pc)
+		}
+	}
+}
+
+// remove closes the connection now if no in-flight calls, otherwise after they finished
+// or CloseTimeout passed, must be called with the mutex held
+func (p *Pool) remove(pc *poolConn) {
+	pc.removed = true
+	if pc.refs == 0 {
+		p.close(pc)
+		return
+	}
+	time.AfterFunc(p.opts.CloseTimeout, func() {
+		p.close(pc)
+	})
+}
+
+func (p *Pool) close(pc *poolConn) {
+	pc.closeOnce.Do(func() {
+		pc.cancel()
+		err := pc.conn.Close()
+		if err != nil {
+			p.opts.Logger.Error("Close connection", zap.String("address", pc.address), zap.Error(err))
+		}
+	})
+}
+
+// acquire returns the connection to the address for a call, false if not connected or unhealthy,
+// release must be called after the call
+func (p *Pool) acquire(address string) (*poolConn, bool) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	pc, ok := p.conns[address]
+	if !ok || !pc.isHealthy() {
+		return nil, false
+	}
+	pc.refs++
+	return pc, true
+}
+
+func (p *Pool) release(pc *poolConn) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	pc.refs--
+	if pc.removed && pc.refs == 0 {
+		p.close(pc)
+	}
+}
+
+// Close closes all connections without waiting for in-flight calls
+func (p *Pool) Close() {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	for addr, pc := range p.conns {
+		delete(p.conns, addr)
+		p.close(pc)
+	}
+}
+
+// checkHealth periodically calls the gRPC health service of the node until ctx is done,
+// nodes not implementing it are considered healthy
+func (p *Pool) checkHealth(ctx context.Context, pc *poolConn) {
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	client := healthpb.NewHealthClient(pc.conn)
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, p.opts.HealthCheckTimeout)
+		res, err := client.Check(checkCtx, &healthpb.HealthCheckRequest{})
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		healthy := err == nil && res.Status == healthpb.HealthCheckResponse_SERVING
+		if status.Code(err) == codes.Unimplemented {
+			healthy = true
+		}
+
+		var value int32
+		if healthy {
+			value = 1
+		}
+		old := atomic.SwapInt32(&pc.healthy, value)
+		if old != value {
+			p.opts.Logger.Info("Health changed",
+				zap.String("address", pc.address), zap.Bool("healthy", healthy), zap.Error(err))
+		}
+	}
+}
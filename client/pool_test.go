@@ -0,0 +1,62 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestPool_GracefulClose(t *testing.T) {
+	p := NewPool(DefaultConnOptions())
+	defer p.Close()
+
+	p.Update([]string{"localhost:1", "localhost:2"})
+
+	pc, ok := p.acquire("localhost:1")
+	assert.Equal(t, true, ok)
+
+	p.Update([]string{"localhost:2"})
+	_, ok = p.acquire("localhost:1")
+	assert.Equal(t, false, ok)
+
+	// closed only after the in-flight call finished
+	assert.NotEqual(t, connectivity.Shutdown, pc.conn.GetState())
+	p.release(pc)
+	assert.Equal(t, connectivity.Shutdown, pc.conn.GetState())
+
+	// unhealthy connections are not used
+	pc, ok = p.acquire("localhost:2")
+	assert.Equal(t, true, ok)
+	p.release(pc)
+	pc.healthy = 0
+	_, ok = p.acquire("localhost:2")
+	assert.Equal(t, false, ok)
+}
+
+func TestPool_ReleaseThenClose(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.CloseTimeout = 10 * time.Millisecond
+	p := NewPool(opts)
+
+	p.Update([]string{"localhost:1"})
+
+	first, ok := p.acquire("localhost:1")
+	assert.Equal(t, true, ok)
+	second, ok := p.acquire("localhost:1")
+	assert.Equal(t, true, ok)
+
+	p.Update(nil)
+	p.release(first)
+	assert.NotEqual(t, connectivity.Shutdown, first.conn.GetState())
+
+	// closed by the last release, then not closed again by the timer
+	p.release(second)
+	assert.Equal(t, connectivity.Shutdown, second.conn.GetState())
+	time.Sleep(2 * opts.CloseTimeout)
+	assert.Equal(t, 0, second.refs)
+
+	p.Close()
+	assert.Equal(t, connectivity.Shutdown, second.conn.GetState())
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"sharding/core"
+
+	"google.golang.org/grpc"
+	// enables the client side health checking of the service config
+	_ "google.golang.org/grpc/health"
+	"google.golang.org/grpc/resolver"
+)
+
+// ProxyScheme is the scheme of the target of DialProxies
+const ProxyScheme = "proxies"
+
+// proxyServiceConfig balances calls across proxies reported SERVING by the gRPC health checking
+const proxyServiceConfig = `{
+	"loadBalancingPolicy": "round_robin",
+	"healthCheckConfig": {"serviceName": ""}
+}`
+
+// proxyResolverBuilder resolves addresses of proxies registered in a core.Service
+type proxyResolverBuilder struct {
+	membership core.Service
+}
+
+var _ resolver.Builder = &proxyResolverBuilder{}
+
+// RegisterProxyResolver registers the resolver of ProxyScheme watching the membership of proxies,
+// must be called once before DialProxies, such as in an init function
+func RegisterProxyResolver(membership core.Service) {
+	resolver.Register(&proxyResolverBuilder{
+		membership: membership,
+	})
+}
+
+// DialProxies connects to all proxies of the membership, calls are balanced across healthy ones
+func DialProxies(opts ConnOptions) (*grpc.ClientConn, error) {
+	dialOpts := append(opts.DialOptions(), grpc.WithDefaultServiceConfig(proxyServiceConfig))
+	return grpc.Dial(ProxyScheme+":///hello", dialOpts...)
+}
+
+func toResolverState(nodes []core.NodeInfo) resolver.State {
+	addresses := make([]resolver.Address, 0, len(nodes))
+	for _, n := range nodes {
+		addresses = append(addresses, resolver.Address{Addr: n.Address})
+	}
+	return resolver.State{Addresses: addresses}
+}
+
+// Build watches the membership until the resolver is closed
+func (b *proxyResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	watchChan := make(chan core.WatchResponse, 1)
+	err := b.membership.Watch(ctx, watchChan)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case wr := <-watchChan:
+				cc.UpdateState(toResolverState(wr.Nodes))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return &proxyResolver{cancel: cancel}, nil
+}
+
+// Scheme ...
+func (b *proxyResolverBuilder) Scheme() string {
+	return ProxyScheme
+}
+
+// proxyResolver is updated by the watch of the membership, nothing to do on ResolveNow
+type proxyResolver struct {
+	cancel context.CancelFunc
+}
+
+// ResolveNow ...
+func (r *proxyResolver) ResolveNow(resolver.ResolveNowOptions) {
+}
+
+// Close ...
+func (r *proxyResolver) Close() {
+	r.cancel()
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"sharding/core"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeMembership struct {
+	core.Service
+	nodes []core.NodeInfo
+}
+
+func (m *fakeMembership) Watch(ctx context.Context, ch chan<- core.WatchResponse) error {
+	ch <- core.WatchResponse{Epoch: 1, Nodes: m.nodes}
+	return nil
+}
+
+type fakeClientConn struct {
+	resolver.ClientConn
+	stateChan chan resolver.State
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) {
+	cc.stateChan <- s
+}
+
+func TestProxyResolver(t *testing.T) {
+	b := &proxyResolverBuilder{
+		membership: &fakeMembership{
+			nodes: []core.NodeInfo{
+				{NodeID: 1, Address: "localhost:7000"},
+				{NodeID: 2, Address: "localhost:7001"},
+			},
+		},
+	}
+	cc := &fakeClientConn{stateChan: make(chan resolver.State, 1)}
+
+	r, err := b.Build(resolver.Target{}, cc, resolver.BuildOptions{})
+	assert.Equal(t, nil, err)
+	defer r.Close()
+
+	select {
+	case s := <-cc.stateChan:
+		assert.Equal(t, []resolver.Address{
+			{Addr: "localhost:7000"},
+			{Addr: "localhost:7001"},
+		}, s.Addresses)
+	case <-time.After(time.Second):
+		t.Fatal("no state updated")
+	}
+}
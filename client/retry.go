@@ -0,0 +1,135 @@
+package client
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// RetryPolicy configures retrying calls to nodes
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt
+	MaxAttempts int
+	// backoff before the n-th retry is InitialBackoff * 2^(n-1) capped at MaxBackoff, with jitter
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// AttemptTimeout bounds each attempt, zero for using only the deadline of the caller
+	AttemptTimeout time.Duration
+	// Budget bounds the total time of a call including backoffs, zero for unlimited
+	Budget time.Duration
+	// RetryableCodes are status codes retried, requests not routed are always retried
+	RetryableCodes []codes.Code
+
+	// ThrottleMaxTokens enables the retry budget shared by all calls of the Client, zero for disabled.
+	// A failed attempt takes a token, a succeeded one gives back ThrottleTokenRatio tokens,
+	// retries are only allowed when more than half of the tokens are left
+	ThrottleMaxTokens  float64
+	ThrottleTokenRatio float64
+}
+
+// DefaultRetryPolicy retries when the ring is changing or nodes are overloaded
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Budget:         10 * time.Second,
+		RetryableCodes: []codes.Code{codes.Aborted, codes.Unavailable, codes.ResourceExhausted},
+	}
+}
+
+// ParseCodes parses status code names such as UNAVAILABLE
+func ParseCodes(names []string) ([]codes.Code, error) {
+	result := make([]codes.Code, 0, len(names))
+	for _, name := range names {
+		var c codes.Code
+		err := c.UnmarshalJSON([]byte(strconv.Quote(name)))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func (p RetryPolicy) retryable(code codes.Code) bool {
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the n-th retry, starting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	if p.InitialBackoff <= 0 {
+		return 0
+	}
+
+	delay := p.MaxBackoff
+	if retry < 32 {
+		d := p.InitialBackoff << uint(retry-1)
+		if d > 0 && (p.MaxBackoff <= 0 || d < p.MaxBackoff) {
+			delay = d
+		}
+	}
+
+	// equal jitter, spreads retries of concurrent calls
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// retryThrottle is the retry budget, prevents retry storms when nodes are failing
+type retryThrottle struct {
+	maxTokens  float64
+	tokenRatio float64
+
+	mut    sync.Mutex
+	tokens float64
+}
+
+// newRetryThrottle returns nil if disabled
+func newRetryThrottle(maxTokens float64, tokenRatio float64) *retryThrottle {
+	if maxTokens <= 0 {
+		return nil
+	}
+	return &retryThrottle{
+		maxTokens:  maxTokens,
+		tokenRatio: tokenRatio,
+		tokens:     maxTokens,
+	}
+}
+
+func (t *retryThrottle) success() {
+	if t == nil {
+		return
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	t.tokens += t.tokenRatio
+	if t.tokens > t.maxTokens {
+		t.tokens = t.maxTokens
+	}
+}
+
+// failure takes a token, returns whether a retry is allowed
+func (t *retryThrottle) failure() bool {
+	if t == nil {
+		return true
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	t.tokens--
+	if t.tokens < 0 {
+		t.tokens = 0
+	}
+	return t.tokens > t.maxTokens/2
+}
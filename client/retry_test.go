@@ -0,0 +1,64 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+
+	table := []struct {
+		name  string
+		retry int
+		max   time.Duration
+	}{
+		{name: "first", retry: 1, max: 100 * time.Millisecond},
+		{name: "third", retry: 3, max: 400 * time.Millisecond},
+		{name: "capped", retry: 5, max: time.Second},
+		{name: "overflow", retry: 100, max: time.Second},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				d := p.backoff(e.retry)
+				assert.True(t, d >= e.max/2 && d <= e.max, d)
+			}
+		})
+	}
+}
+
+func TestRetryThrottle(t *testing.T) {
+	th := newRetryThrottle(4, 0.5)
+
+	assert.Equal(t, true, th.failure())
+	assert.Equal(t, false, th.failure())
+	assert.Equal(t, false, th.failure())
+
+	// recovered after enough successes, capped at the max tokens
+	for i := 0; i < 10; i++ {
+		th.success()
+	}
+	assert.Equal(t, true, th.failure())
+	assert.Equal(t, false, th.failure())
+
+	// disabled
+	var disabled *retryThrottle
+	assert.Equal(t, true, disabled.failure())
+}
+
+func TestParseCodes(t *testing.T) {
+	result, err := ParseCodes([]string{"UNAVAILABLE", "RESOURCE_EXHAUSTED"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []codes.Code{codes.Unavailable, codes.ResourceExhausted}, result)
+
+	_, err = ParseCodes([]string{"UNKNOWN_CODE"})
+	assert.Error(t, err)
+}
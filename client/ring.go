@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sharding/core"
+	rpc "sharding/rpc/hello/v1"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ringRetryDelay is the delay before watching the next seed after a stream was broken
+const ringRetryDelay = 1 * time.Second
+
+var (
+	// ErrKeepAliveNotSupported is returned by RingService.KeepAliveAndWatch
+	ErrKeepAliveNotSupported = errors.New("keep alive is not supported by RingService")
+
+	errNoSeeds = errors.New("no seeds for watching the ring")
+)
+
+// RingService learns nodes of the ring from the WatchRing stream of any node or proxy,
+// without direct access to the service discovery
+type RingService struct {
+	seeds    []string
+	dialOpts []grpc.DialOption
+}
+
+var _ core.Service = &RingService{}
+
+// NewRingService creates a RingService watching seeds in round robin
+func NewRingService(seeds []string, opts ConnOptions) *RingService {
+	return &RingService{
+		seeds:    seeds,
+		dialOpts: opts.DialOptions(),
+	}
+}
+
+// KeepAliveAndWatch is not supported, nodes must register themselves to the service discovery
+func (s *RingService) KeepAliveAndWatch(ctx context.Context, info core.NodeInfo,
+	ch chan<- core.WatchResponse,
+) error {
+	return ErrKeepAliveNotSupported
+}
+
+// Watch streams views of the ring in background, switches to the next seed when a stream is broken
+func (s *RingService) Watch(ctx context.Context, ch chan<- core.WatchResponse) error {
+	if len(s.seeds) == 0 {
+		return errNoSeeds
+	}
+
+	go s.watchLoop(ctx, ch)
+	return nil
+}
+
+func (s *RingService) watchLoop(ctx context.Context, ch chan<- core.WatchResponse) {
+	// views older than the last one are skipped after switching seeds
+	var epoch uint64
+	for i := 0; ; i++ {
+		addr := s.seeds[i%len(s.seeds)]
+		err := s.watchSeed(ctx, addr, ch, &epoch)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Println("Watch ring:", addr, err)
+
+		select {
+		case <-time.After(ringRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *RingService) watchSeed(ctx context.Context, addr string, ch chan<- core.WatchResponse,
+	epoch *uint64,
+) error {
+	conn, err := grpc.DialContext(ctx, addr, s.dialOpts...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	stream, err := rpc.NewHelloClient(conn).WatchRing(ctx, &rpc.WatchRingRequest{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if res.Epoch < *epoch {
+			continue
+		}
+		*epoch = res.Epoch
+
+		select {
+		case ch <- toWatchResponse(res):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func toWatchResponse(res *rpc.WatchRingResponse) core.WatchResponse {
+	nodes := make([]core.NodeInfo, 0, len(res.Nodes))
+	for _, n := range res.Nodes {
+		nodes = append(nodes, core.NodeInfo{
+			NodeID:  core.NodeID(n.NodeId),
+			Hash:    core.Hash(n.Hash),
+			Address: n.Address,
+		})
+	}
+	core.Sort(nodes)
+
+	return core.WatchResponse{
+		Epoch: res.Epoch,
+		Nodes: nodes,
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"sharding/core"
+	"sync"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// Route is the owner of a hash with the connection to it
+type Route struct {
+	NodeID  core.NodeID
+	Address string
+	Conn    *grpc.ClientConn
+
+	release func()
+}
+
+// Release must be called after the calls using the route finished
+func (rt Route) Release() {
+	if rt.release != nil {
+		rt.release()
+	}
+}
+
+// Router keeps the view of the ring and connections to its nodes
+type Router struct {
+	pool   *Pool
+	logger *zap.Logger
+
+	mut   sync.RWMutex
+	nodes []core.NodeInfo
+}
+
+// NewRouter creates a Router without any nodes
+func NewRouter(opts ConnOptions) *Router {
+	pool := NewPool(opts)
+	return &Router{
+		pool:   pool,
+		logger: pool.opts.Logger,
+	}
+}
+
+// Watch updates the nodes, connects to new nodes and disconnects from removed ones
+// after their in-flight calls finished
+func (r *Router) Watch(newNodes []core.NodeInfo) {
+	r.logger.Info("Nodes changed", zap.Any("nodes", newNodes))
+
+	addresses := make([]string, 0, len(newNodes))
+	for _, n := range newNodes {
+		addresses = append(addresses, n.Address)
+	}
+	r.pool.Update(addresses)
+
+	r.mut.Lock()
+	r.nodes = newNodes
+	r.mut.Unlock()
+}
+
+func (r *Router) getNodes() []core.NodeInfo {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	return r.nodes
+}
+
+func (r *Router) acquireRoute(node core.NodeInfo) (Route, bool) {
+	pc, ok := r.pool.acquire(node.Address)
+	if !ok {
+		return Route{}, false
+	}
+
+	return Route{
+		NodeID:  node.NodeID,
+		Address: node.Address,
+		Conn:    pc.conn,
+		release: func() {
+			r.pool.release(pc)
+		},
+	}, true
+}
+
+// GetRoute returns false if no node owns the hash or no healthy connection to the owner,
+// the route must be released
+func (r *Router) GetRoute(hash core.Hash) (Route, bool) {
+	nodes := r.getNodes()
+
+	nullNodeID := core.GetNodeID(nodes, hash)
+	nullAddress := core.GetNodeAddress(nodes, hash)
+	if !nullNodeID.Valid || !nullAddress.Valid {
+		return Route{}, false
+	}
+
+	return r.acquireRoute(core.NodeInfo{
+		NodeID:  nullNodeID.NodeID,
+		Address: nullAddress.Address,
+	})
+}
+
+// Close closes all connections
+func (r *Router) Close() {
+	r.pool.Close()
+}
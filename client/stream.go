@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"io"
+	rpc "sharding/rpc/hello/v1"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// nodeStream multiplexes Increase requests to a node over one StreamIncrease stream
+type nodeStream struct {
+	stream rpc.Hello_StreamIncreaseClient
+	cancel context.CancelFunc
+	// sendChan passes requests to the sending goroutine, callers do not block in Send
+	sendChan chan *rpc.StreamIncreaseRequest
+	// done is closed after the stream was broken
+	done chan struct{}
+
+	mut     sync.Mutex
+	nextID  uint64
+	waiting map[uint64]chan increaseResult
+	// err is not nil after the stream was broken
+	err error
+}
+
+func newNodeStream(stream rpc.Hello_StreamIncreaseClient, cancel context.CancelFunc) *nodeStream {
+	return &nodeStream{
+		stream:   stream,
+		cancel:   cancel,
+		sendChan: make(chan *rpc.StreamIncreaseRequest),
+		done:     make(chan struct{}),
+		waiting:  make(map[uint64]chan increaseResult),
+	}
+}
+
+// streamMux keeps a stream per node
+type streamMux struct {
+	mut     sync.Mutex
+	streams map[*grpc.ClientConn]*nodeStream
+}
+
+func newStreamMux() *streamMux {
+	return &streamMux{
+		streams: make(map[*grpc.ClientConn]*nodeStream),
+	}
+}
+
+func (m *streamMux) increase(ctx context.Context, conn *grpc.ClientConn, req *rpc.IncreaseRequest,
+) (*rpc.IncreaseResponse, error) {
+	ns, err := m.getStream(conn)
+	if err != nil {
+		return nil, err
+	}
+	return ns.increase(ctx, req)
+}
+
+// getStream opens a new stream if none or the previous one was broken
+func (m *streamMux) getStream(conn *grpc.ClientConn) (*nodeStream, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	ns, existed := m.streams[conn]
+	if existed && !ns.broken() {
+		return ns, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := rpc.NewHelloClient(conn).StreamIncrease(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ns = newNodeStream(stream, cancel)
+	m.streams[conn] = ns
+
+	go ns.sendLoop()
+	go func() {
+		ns.receive()
+
+		m.mut.Lock()
+		if m.streams[conn] == ns {
+			delete(m.streams, conn)
+		}
+		m.mut.Unlock()
+	}()
+	return ns, nil
+}
+
+func (ns *nodeStream) broken() bool {
+	ns.mut.Lock()
+	defer ns.mut.Unlock()
+
+	return ns.err != nil
+}
+
+func (ns *nodeStream) remove(id uint64) {
+	ns.mut.Lock()
+	defer ns.mut.Unlock()
+
+	delete(ns.waiting, id)
+}
+
+// streamTimeoutMs passes the deadline of the request to the server, zero for none
+func streamTimeoutMs(ctx context.Context) uint32 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	ms := time.Until(deadline) / time.Millisecond
+	if ms < 1 {
+		return 1
+	}
+	return uint32(ms)
+}
+
+func (ns *nodeStream) increase(ctx context.Context, req *rpc.IncreaseRequest) (*rpc.IncreaseResponse, error) {
+	resultChan := make(chan increaseResult, 1)
+
+	ns.mut.Lock()
+	if ns.err != nil {
+		err := ns.err
+		ns.mut.Unlock()
+		return nil, err
+	}
+	ns.nextID++
+	id := ns.nextID
+	ns.waiting[id] = resultChan
+	ns.mut.Unlock()
+
+	select {
+	case ns.sendChan <- &rpc.StreamIncreaseRequest{
+		CorrelationId: id,
+		Request:       req,
+		TimeoutMs:     streamTimeoutMs(ctx),
+	}:
+	case <-ctx.Done():
+		ns.remove(id)
+		return nil, contextStatusError(ctx)
+	case <-ns.done:
+		// the request was replied by fail
+	}
+
+	select {
+	case r := <-resultChan:
+		return r.res, r.err
+	case <-ctx.Done():
+		ns.remove(id)
+		return nil, contextStatusError(ctx)
+	}
+}
+
+// sendLoop sends requests in order until the stream was broken
+func (ns *nodeStream) sendLoop() {
+	for {
+		select {
+		case req := <-ns.sendChan:
+			err := ns.stream.Send(req)
+			if err != nil {
+				// the error of the stream is received by the receiving goroutine
+				ns.cancel()
+				return
+			}
+		case <-ns.done:
+			return
+		}
+	}
+}
+
+func (ns *nodeStream) receive() {
+	for {
+		res, err := ns.stream.Recv()
+		if err != nil {
+			ns.fail(err)
+			return
+		}
+
+		ns.mut.Lock()
+		resultChan, ok := ns.waiting[res.CorrelationId]
+		delete(ns.waiting, res.CorrelationId)
+		ns.mut.Unlock()
+		if !ok {
+			// the caller was aborted
+			continue
+		}
+
+		code := codes.Code(res.Code)
+		if code != codes.OK {
+			resultChan <- increaseResult{err: status.Error(code, res.Message)}
+			continue
+		}
+		resultChan <- increaseResult{res: &rpc.IncreaseResponse{Value: res.Value}}
+	}
+}
+
+// fail replies Unavailable to waiting requests for being retried on a new stream
+func (ns *nodeStream) fail(err error) {
+	if err == io.EOF {
+		err = status.Error(codes.Unavailable, "stream closed by the server")
+	} else {
+		err = status.Error(codes.Unavailable, err.Error())
+	}
+
+	ns.mut.Lock()
+	ns.err = err
+	waiting := ns.waiting
+	ns.waiting = nil
+	ns.mut.Unlock()
+
+	for _, resultChan := range waiting {
+		resultChan <- increaseResult{err: err}
+	}
+	close(ns.done)
+	ns.cancel()
+}
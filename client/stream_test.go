@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"errors"
+	rpc "sharding/rpc/hello/v1"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeStreamServer replies the counter ids as values, the stream is failed when the counter is failedCounter
+type fakeStreamServer struct {
+	fakeHelloServer
+	// reversePairs replies every pair of requests in reverse order
+	reversePairs bool
+}
+
+const failedCounter = 1000
+
+func (s *fakeStreamServer) StreamIncrease(stream rpc.Hello_StreamIncreaseServer) error {
+	var pending []*rpc.StreamIncreaseRequest
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if req.Request.Counter == failedCounter {
+			return status.Error(codes.Internal, "failed")
+		}
+
+		pending = append(pending, req)
+		if s.reversePairs && len(pending) < 2 {
+			continue
+		}
+		for i := len(pending) - 1; i >= 0; i-- {
+			err := stream.Send(&rpc.StreamIncreaseResponse{
+				CorrelationId: pending[i].CorrelationId,
+				Value:         pending[i].Request.Counter,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		pending = nil
+	}
+}
+
+func TestStreamMux_Correlation(t *testing.T) {
+	conn, closeConn := newTestConn(t, &fakeStreamServer{reversePairs: true})
+	defer closeConn()
+
+	m := newStreamMux()
+
+	values := make([]uint32, 4)
+	var wg sync.WaitGroup
+	wg.Add(len(values))
+	for i := range values {
+		index := i
+		go func() {
+			defer wg.Done()
+			res, err := m.increase(context.Background(), conn, &rpc.IncreaseRequest{Counter: uint32(10 + index)})
+			assert.Equal(t, nil, err)
+			if err == nil {
+				values[index] = res.Value
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, []uint32{10, 11, 12, 13}, values)
+}
+
+func TestStreamMux_Fail(t *testing.T) {
+	conn, closeConn := newTestConn(t, &fakeStreamServer{})
+	defer closeConn()
+
+	m := newStreamMux()
+	ns, err := m.getStream(conn)
+	assert.Equal(t, nil, err)
+
+	// the waiting request is replied Unavailable for being retried
+	_, err = m.increase(context.Background(), conn, &rpc.IncreaseRequest{Counter: failedCounter})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, true, ns.broken())
+
+	_, err = ns.increase(context.Background(), &rpc.IncreaseRequest{Counter: 10})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// a new stream is opened
+	newNS, err := m.getStream(conn)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, ns, newNS)
+}
+
+// blockedStream blocks in Send until closed
+type blockedStream struct {
+	grpc.ClientStream
+	closeChan chan struct{}
+}
+
+func (s *blockedStream) Send(req *rpc.StreamIncreaseRequest) error {
+	<-s.closeChan
+	return errors.New("closed")
+}
+
+func (s *blockedStream) Recv() (*rpc.StreamIncreaseResponse, error) {
+	<-s.closeChan
+	return nil, errors.New("closed")
+}
+
+func TestNodeStream_IncreaseBlockedInSend(t *testing.T) {
+	stream := &blockedStream{closeChan: make(chan struct{})}
+	ns := newNodeStream(stream, func() {})
+	go ns.sendLoop()
+	go ns.receive()
+	defer close(stream.closeChan)
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := ns.increase(ctx, &rpc.IncreaseRequest{Counter: 10})
+		cancel()
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	}
+
+	ns.mut.Lock()
+	assert.Equal(t, 0, len(ns.waiting))
+	ns.mut.Unlock()
+}
+
+func BenchmarkStreamMux_Increase(b *testing.B) {
+	conn, closeConn := newTestConn(b, &fakeStreamServer{})
+	defer closeConn()
+
+	m := newStreamMux()
+	req := &rpc.IncreaseRequest{Counter: 10}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _ = m.increase(context.Background(), conn, req)
+		}
+	})
+}
+
+func BenchmarkBatcher_Increase(b *testing.B) {
+	conn, closeConn := newTestConn(b, &fakeHelloServer{})
+	defer closeConn()
+
+	batcher := newBatcher(time.Millisecond, 100)
+	req := &rpc.IncreaseRequest{Counter: 10}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _ = batcher.increase(context.Background(), conn, req)
+		}
+	})
+}
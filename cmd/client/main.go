@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"sharding/client"
+	"sharding/config"
+	"sharding/core/impl"
 	hello_rpc "sharding/rpc/hello/v1"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"google.golang.org/grpc"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -46,21 +50,65 @@ func concurrent(num int, threadCount int, printCount uint64, fn func(k int)) {
 	wg.Wait()
 }
 
-func main() {
-	conn, err := grpc.Dial("localhost:7000", grpc.WithInsecure())
+// increaseFunc is the Increase of the client or of the connection to proxies
+type increaseFunc func(ctx context.Context, req *hello_rpc.IncreaseRequest) (*hello_rpc.IncreaseResponse, error)
+
+// dialProxies balances calls across healthy proxies of the membership
+func dialProxies(connOpts client.ConnOptions) increaseFunc {
+	client.RegisterProxyResolver(impl.NewEtcdProxyService())
+	conn, err := client.DialProxies(connOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	helloClient := hello_rpc.NewHelloClient(conn)
+	return func(ctx context.Context, req *hello_rpc.IncreaseRequest) (*hello_rpc.IncreaseResponse, error) {
+		return helloClient.Increase(ctx, req)
+	}
+}
+
+// dialNodes learns the ring from any node, calls owner nodes directly instead of going through the proxy
+func dialNodes(ctx context.Context, cfg config.Config, connOpts client.ConnOptions) increaseFunc {
+	seeds := make([]string, 0, len(cfg.Nodes))
+	for _, n := range cfg.Nodes {
+		seeds = append(seeds, n.ToAddress())
+	}
+
+	c := client.New(connOpts)
+	c.EnableStreaming()
+	err := c.Start(ctx, client.NewRingService(seeds, connOpts))
 	if err != nil {
 		panic(err)
 	}
+	return c.Increase
+}
 
-	client := hello_rpc.NewHelloClient(conn)
+func main() {
 	ctx := context.Background()
-	req := &hello_rpc.IncreaseRequest{
-		Counter: 150,
+
+	cfg := config.LoadConfig()
+	connOpts := client.DefaultConnOptions()
+
+	var increase increaseFunc
+	if cfg.Client.DialProxies {
+		increase = dialProxies(connOpts)
+	} else {
+		increase = dialNodes(ctx, cfg, connOpts)
 	}
 
 	start := time.Now()
 	concurrent(10000, 100, 1000, func(k int) {
-		_, err := client.Increase(ctx, req)
+		// a new request id per increase, retries reuse it
+		req := &hello_rpc.IncreaseRequest{
+			Counter:   150,
+			RequestId: uuid.New().String(),
+		}
+
+		_, err := increase(ctx, req)
+		for retry := 0; status.Code(err) == codes.ResourceExhausted && retry < 5; retry++ {
+			time.Sleep(100 * time.Millisecond << uint(retry))
+			_, err = increase(ctx, req)
+		}
 		if err != nil {
 			st, ok := status.FromError(err)
 			if ok {
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sharding/core"
+	"sharding/domain/hello"
+	hello_repo "sharding/repo/hello"
+
+	"github.com/jmoiron/sqlx"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const backfillBatchSize = 1000
+
+// backfills hashes of counters stored before migrations/0002_counter_columns.sql,
+// must be run before migrations/0003_counter_hash_not_null.sql
+func main() {
+	ctx := context.Background()
+
+	db := sqlx.MustConnect("mysql", "root:1@tcp(localhost:3306)/bench?parseTime=true")
+	repo := hello_repo.NewRepo(db)
+
+	hashFn := func(id hello.CounterID) core.Hash {
+		return core.HashUint32(uint32(id))
+	}
+
+	total := 0
+	for {
+		n, err := repo.BackfillHashes(ctx, hashFn, backfillBatchSize)
+		if err != nil {
+			panic(err)
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+		fmt.Println("Backfilled", total, "counters")
+	}
+	fmt.Println("Done")
+}
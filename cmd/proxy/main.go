@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sharding/config"
 	"sharding/domain/errors"
 	service "sharding/service"
 	"sync"
@@ -20,6 +21,7 @@ import (
 	"go.uber.org/zap"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -29,7 +31,14 @@ func deciderAllMethods(ctx context.Context, fullMethodName string, servingObject
 }
 
 func initServer(logger *zap.Logger) (*grpc.Server, *service.ProxyRoot) {
+	connConfig := config.LoadConfig().Conn
+
 	server := grpc.NewServer(
+		// permits keepalive pings of clients dialing proxies
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             connConfig.KeepaliveTime,
+			PermitWithoutStream: true,
+		}),
 		grpc.UnaryInterceptor(
 			grpc_middleware.ChainUnaryServer(
 				grpc_ctxtags.UnaryServerInterceptor(),
@@ -115,14 +124,19 @@ func main() {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
+	runDone := make(chan struct{})
 	go func() {
 		root.Run(ctx)
+		close(runDone)
 	}()
 
 	signal := <-exit
 	fmt.Println("SIGNAL", signal)
 	cancel()
 
+	// clients move to other proxies before the server stops
+	<-runDone
+
 	server.GracefulStop()
 
 	err = httpServer.Shutdown(ctx)
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sharding/config"
 	"sharding/domain/errors"
 	service "sharding/service"
 	"sync"
@@ -20,6 +21,7 @@ import (
 	"go.uber.org/zap"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -29,7 +31,14 @@ func deciderAllMethods(ctx context.Context, fullMethodName string, servingObject
 }
 
 func initServer(logger *zap.Logger) (*grpc.Server, *service.Root) {
+	connConfig := config.LoadConfig().Conn
+
 	server := grpc.NewServer(
+		// permits keepalive pings of proxies and other nodes
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             connConfig.KeepaliveTime,
+			PermitWithoutStream: true,
+		}),
 		grpc.UnaryInterceptor(
 			grpc_middleware.ChainUnaryServer(
 				grpc_ctxtags.UnaryServerInterceptor(),
@@ -85,7 +94,7 @@ func main() {
 	}
 
 	var wg sync.WaitGroup
-	wg.Add(3)
+	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
@@ -115,8 +124,9 @@ func main() {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
+	rootDone := make(chan struct{})
 	go func() {
-		defer wg.Done()
+		defer close(rootDone)
 
 		root.Run(ctx)
 	}()
@@ -125,9 +135,12 @@ func main() {
 	fmt.Println("SIGNAL", signal)
 	cancel()
 
+	// queued commands are replied before stopping the server
+	<-rootDone
+
 	server.GracefulStop()
 
-	err = httpServer.Shutdown(ctx)
+	err = httpServer.Shutdown(context.Background())
 	if err != nil {
 		logger.Error("httpServer Shutdown", zap.Error(err))
 	}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"sharding/core"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -17,13 +18,164 @@ type NodeConfig struct {
 
 // ProxyConfig for configure proxy
 type ProxyConfig struct {
+	// Port of the single proxy started without an id, not registered in the membership of proxies
 	Port uint16 `mapstructure:"port"`
+	// RingSeeds are addresses of nodes for watching the ring by WatchRing, empty for using etcd
+	RingSeeds []string `mapstructure:"ring_seeds"`
+
+	// BatchWindow is the time coalescing Increase requests per node, zero for disabled
+	BatchWindow  time.Duration `mapstructure:"batch_window"`
+	MaxBatchSize int           `mapstructure:"max_batch_size"`
+
+	// Streaming multiplexes Increase requests per node over one stream instead of batching
+	Streaming bool `mapstructure:"streaming"`
+
+	Retry   RetryConfig   `mapstructure:"retry"`
+	Breaker BreakerConfig `mapstructure:"breaker"`
+	Hedge   HedgeConfig   `mapstructure:"hedge"`
+}
+
+// RetryConfig for configure retrying calls from proxies to nodes
+type RetryConfig struct {
+	// MaxAttempts includes the first attempt
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// exponential backoff with jitter between attempts
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	// AttemptTimeout bounds each attempt, zero for using only the deadline of the request
+	AttemptTimeout time.Duration `mapstructure:"attempt_timeout"`
+	// Budget bounds the total time of a request including backoffs, zero for unlimited
+	Budget time.Duration `mapstructure:"budget"`
+	// RetryableCodes are names of gRPC status codes, such as UNAVAILABLE
+	RetryableCodes []string `mapstructure:"retryable_codes"`
+
+	// failed attempts take a token, succeeded ones give back TokenRatio tokens,
+	// retries are only allowed when more than half of MaxTokens are left, zero for disabled
+	MaxTokens  float64 `mapstructure:"max_tokens"`
+	TokenRatio float64 `mapstructure:"token_ratio"`
+}
+
+// BreakerConfig for configure circuit breakers of proxies per node
+type BreakerConfig struct {
+	// Enabled fails fast with Unavailable when calling unhealthy nodes
+	Enabled bool `mapstructure:"enabled"`
+	// ConsecutiveFailures opens the breaker, zero for disabled
+	ConsecutiveFailures int `mapstructure:"consecutive_failures"`
+	// ErrorRate of the window opens the breaker after MinRequests, zero for disabled
+	ErrorRate   float64       `mapstructure:"error_rate"`
+	MinRequests int           `mapstructure:"min_requests"`
+	Window      time.Duration `mapstructure:"window"`
+	// OpenDuration is the time failing fast before probing the node again
+	OpenDuration   time.Duration `mapstructure:"open_duration"`
+	HalfOpenProbes int           `mapstructure:"half_open_probes"`
+}
+
+// HedgeConfig for configure hedging stale reads of proxies to the next node of the ring
+type HedgeConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Percentile of recent read latencies used as the delay before hedging
+	Percentile float64 `mapstructure:"percentile"`
+	// InitialDelay is used until enough latencies were observed
+	InitialDelay time.Duration `mapstructure:"initial_delay"`
+	MinDelay     time.Duration `mapstructure:"min_delay"`
+}
+
+// Durability modes of processor
+const (
+	// DurabilitySync persists every batch before replying
+	DurabilitySync = "sync"
+	// DurabilityGroupCommit waits up to GroupCommitDelay for a bigger batch
+	DurabilityGroupCommit = "group_commit"
+	// DurabilityWriteBehind replies after applying in memory and persists every FlushInterval
+	DurabilityWriteBehind = "write_behind"
+)
+
+// ProcessorConfig for configure processor of a node
+type ProcessorConfig struct {
+	// Shards is the number of processors of a node, each one has its own WAL and snapshot,
+	// the WAL must be empty (after a graceful shutdown) when changing it
+	Shards int `mapstructure:"shards"`
+
+	// CacheSize is the max number of counters kept in memory
+	CacheSize int `mapstructure:"cache_size"`
+	// CommandTimeout is used for requests without deadline
+	CommandTimeout time.Duration `mapstructure:"command_timeout"`
+
+	// commands are rejected when the queue depth or the estimated wait of a shard
+	// exceeds the limits, zero for unlimited
+	MaxQueueDepth int           `mapstructure:"max_queue_depth"`
+	MaxQueueWait  time.Duration `mapstructure:"max_queue_wait"`
+
+	Durability       string        `mapstructure:"durability"`
+	GroupCommitDelay time.Duration `mapstructure:"group_commit_delay"`
+	FlushInterval    time.Duration `mapstructure:"flush_interval"`
+
+	// WALDir enables the local write ahead log of the write behind mode
+	WALDir string `mapstructure:"wal_dir"`
+
+	// SnapshotDir enables periodic snapshots of the processor state
+	SnapshotDir      string        `mapstructure:"snapshot_dir"`
+	SnapshotInterval time.Duration `mapstructure:"snapshot_interval"`
+
+	// ExpireInterval checks expired counters of the cache
+	ExpireInterval time.Duration `mapstructure:"expire_interval"`
+	// ExpireSweepInterval deletes expired rows not in the cache from the database
+	ExpireSweepInterval time.Duration `mapstructure:"expire_sweep_interval"`
+}
+
+// ForwardConfig for configure forwarding requests between nodes
+type ForwardConfig struct {
+	// Enabled lets clients call any node directly, requests are forwarded to their owners
+	Enabled bool `mapstructure:"enabled"`
+	// MaxHops bounds forwarding of a request when nodes have different views of the ring
+	MaxHops int `mapstructure:"max_hops"`
+}
+
+// ConnConfig for configure connections of proxies and nodes to nodes
+type ConnConfig struct {
+	// backoff of reconnecting
+	BaseDelay         time.Duration `mapstructure:"base_delay"`
+	MaxDelay          time.Duration `mapstructure:"max_delay"`
+	MinConnectTimeout time.Duration `mapstructure:"min_connect_timeout"`
+
+	// keepalive pings, also the min interval of pings permitted by servers, zero for disabled
+	KeepaliveTime    time.Duration `mapstructure:"keepalive_time"`
+	KeepaliveTimeout time.Duration `mapstructure:"keepalive_timeout"`
+
+	// HealthCheckInterval of the gRPC health checking, zero for disabled
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval"`
+	HealthCheckTimeout  time.Duration `mapstructure:"health_check_timeout"`
+
+	// CloseTimeout bounds waiting for in-flight calls before closing connections to removed nodes
+	CloseTimeout time.Duration `mapstructure:"close_timeout"`
+}
+
+// ClientConfig for configure the benchmark client
+type ClientConfig struct {
+	// DialProxies calls proxies registered in the membership of proxies
+	// instead of calling owner nodes directly
+	DialProxies bool `mapstructure:"dial_proxies"`
+}
+
+// ShutdownConfig for configure graceful shutdown of a node
+type ShutdownConfig struct {
+	// PropagationDelay is the time waiting for proxies to observe the removal of the node
+	PropagationDelay time.Duration `mapstructure:"propagation_delay"`
+	// Timeout is the deadline of the whole shutdown
+	Timeout time.Duration `mapstructure:"timeout"`
 }
 
 // Config for app config
 type Config struct {
 	Nodes []NodeConfig `mapstructure:"nodes"`
-	Proxy ProxyConfig  `mapstructure:"proxy"`
+	// Proxies are instances of proxies registered in the membership of proxies, hashes are not used
+	Proxies   []NodeConfig    `mapstructure:"proxies"`
+	Proxy     ProxyConfig     `mapstructure:"proxy"`
+	Processor ProcessorConfig `mapstructure:"processor"`
+	Forward   ForwardConfig   `mapstructure:"forward"`
+	Conn      ConnConfig      `mapstructure:"conn"`
+	Shutdown  ShutdownConfig  `mapstructure:"shutdown"`
+	Client    ClientConfig    `mapstructure:"client"`
 }
 
 // ToAddress constructs a full address
@@ -54,9 +206,24 @@ func initConfig(vip *viper.Viper) Config {
 		panic(err)
 	}
 
+	err = cfg.Processor.validate()
+	if err != nil {
+		panic(err)
+	}
+
 	return cfg
 }
 
+// validate checks values not checked by unmarshalling
+func (c ProcessorConfig) validate() error {
+	switch c.Durability {
+	case DurabilitySync, DurabilityGroupCommit, DurabilityWriteBehind:
+		return nil
+	default:
+		return fmt.Errorf("invalid processor durability: %q", c.Durability)
+	}
+}
+
 // LoadConfig loads the config from file
 func LoadConfig() Config {
 	vip := viper.New()
@@ -64,6 +231,50 @@ func LoadConfig() Config {
 	vip.SetConfigType("yml")
 	vip.AddConfigPath(".")
 
+	vip.SetDefault("proxy.batch_window", 1*time.Millisecond)
+	vip.SetDefault("proxy.max_batch_size", 500)
+	vip.SetDefault("proxy.retry.max_attempts", 4)
+	vip.SetDefault("proxy.retry.initial_backoff", 50*time.Millisecond)
+	vip.SetDefault("proxy.retry.max_backoff", 2*time.Second)
+	vip.SetDefault("proxy.retry.attempt_timeout", 3*time.Second)
+	vip.SetDefault("proxy.retry.budget", 10*time.Second)
+	vip.SetDefault("proxy.retry.retryable_codes", []string{"ABORTED", "UNAVAILABLE", "RESOURCE_EXHAUSTED"})
+	vip.SetDefault("proxy.retry.max_tokens", 100)
+	vip.SetDefault("proxy.retry.token_ratio", 0.1)
+	vip.SetDefault("proxy.breaker.enabled", true)
+	vip.SetDefault("proxy.breaker.consecutive_failures", 5)
+	vip.SetDefault("proxy.breaker.error_rate", 0.5)
+	vip.SetDefault("proxy.breaker.min_requests", 20)
+	vip.SetDefault("proxy.breaker.window", 10*time.Second)
+	vip.SetDefault("proxy.breaker.open_duration", 5*time.Second)
+	vip.SetDefault("proxy.breaker.half_open_probes", 1)
+	vip.SetDefault("proxy.hedge.enabled", true)
+	vip.SetDefault("proxy.hedge.percentile", 0.95)
+	vip.SetDefault("proxy.hedge.initial_delay", 10*time.Millisecond)
+	vip.SetDefault("proxy.hedge.min_delay", 1*time.Millisecond)
+	vip.SetDefault("processor.shards", 1)
+	vip.SetDefault("processor.cache_size", 1000000)
+	vip.SetDefault("processor.command_timeout", 10*time.Second)
+	vip.SetDefault("processor.max_queue_depth", 8000)
+	vip.SetDefault("processor.max_queue_wait", 1*time.Second)
+	vip.SetDefault("processor.durability", DurabilitySync)
+	vip.SetDefault("processor.group_commit_delay", 2*time.Millisecond)
+	vip.SetDefault("processor.flush_interval", 100*time.Millisecond)
+	vip.SetDefault("processor.snapshot_interval", 5*time.Minute)
+	vip.SetDefault("processor.expire_interval", 1*time.Second)
+	vip.SetDefault("processor.expire_sweep_interval", 1*time.Minute)
+	vip.SetDefault("forward.max_hops", 2)
+	vip.SetDefault("conn.base_delay", 5*time.Second)
+	vip.SetDefault("conn.max_delay", 10*time.Second)
+	vip.SetDefault("conn.min_connect_timeout", 5*time.Second)
+	vip.SetDefault("conn.keepalive_time", 30*time.Second)
+	vip.SetDefault("conn.keepalive_timeout", 10*time.Second)
+	vip.SetDefault("conn.health_check_interval", 2*time.Second)
+	vip.SetDefault("conn.health_check_timeout", 1*time.Second)
+	vip.SetDefault("conn.close_timeout", 10*time.Second)
+	vip.SetDefault("shutdown.propagation_delay", 2*time.Second)
+	vip.SetDefault("shutdown.timeout", 30*time.Second)
+
 	err := vip.ReadInConfig()
 	if err != nil {
 		panic(err)
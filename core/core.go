@@ -30,8 +30,16 @@ type (
 		NodeID NodeID
 	}
 
+	// HashRange for an inclusive range of hash values
+	HashRange struct {
+		Begin Hash
+		End   Hash
+	}
+
 	//WatchResponse for each watch response
 	WatchResponse struct {
+		// Epoch increases on every change of nodes
+		Epoch uint64
 		Nodes []NodeInfo
 	}
 
@@ -2,6 +2,7 @@ package core
 
 import (
 	"encoding/binary"
+	"math"
 	"sort"
 
 	"github.com/spaolacci/murmur3"
@@ -60,14 +61,13 @@ type nullNodeInfo struct {
 	Node  NodeInfo
 }
 
-func getConsistentHashingElem(sortedNodes []NodeInfo, hash Hash) nullNodeInfo {
-	if len(sortedNodes) == 0 {
-		return nullNodeInfo{
-			Valid: false,
-		}
+// getConsistentHashingIndex returns the index of the owner node, -1 if no nodes
+func getConsistentHashingIndex(sortedNodes []NodeInfo, hash Hash) int {
+	n := len(sortedNodes)
+	if n == 0 {
+		return -1
 	}
 
-	n := len(sortedNodes)
 	first := 0
 	last := n
 
@@ -83,16 +83,44 @@ func getConsistentHashingElem(sortedNodes []NodeInfo, hash Hash) nullNodeInfo {
 	}
 
 	if first == n {
+		return 0
+	}
+	return first
+}
+
+func getConsistentHashingElem(sortedNodes []NodeInfo, hash Hash) nullNodeInfo {
+	index := getConsistentHashingIndex(sortedNodes, hash)
+	if index < 0 {
 		return nullNodeInfo{
-			Valid: true,
-			Node:  sortedNodes[0],
+			Valid: false,
 		}
 	}
 
 	return nullNodeInfo{
 		Valid: true,
-		Node:  sortedNodes[first],
+		Node:  sortedNodes[index],
+	}
+}
+
+// GetNextNodes returns at most n nodes with different addresses in the order of the ring,
+// starting from the owner of the hash
+func GetNextNodes(sortedNodes []NodeInfo, hash Hash, n int) []NodeInfo {
+	index := getConsistentHashingIndex(sortedNodes, hash)
+	if index < 0 {
+		return nil
+	}
+
+	var result []NodeInfo
+	seen := make(map[string]struct{})
+	for i := 0; i < len(sortedNodes) && len(result) < n; i++ {
+		node := sortedNodes[(index+i)%len(sortedNodes)]
+		if _, existed := seen[node.Address]; existed {
+			continue
+		}
+		seen[node.Address] = struct{}{}
+		result = append(result, node)
 	}
+	return result
 }
 
 // GetNodeAddress returns the address of node for consistent hashing
@@ -122,3 +150,94 @@ func GetNodeID(sortedNodes []NodeInfo, hash Hash) NullNodeID {
 		NodeID: nullNode.Node.NodeID,
 	}
 }
+
+// GetOwnedRanges returns the hash ranges owned by the node, sorted by Begin.
+// Nodes with the same hash are resolved like GetNodeID
+func GetOwnedRanges(sortedNodes []NodeInfo, nodeID NodeID) []HashRange {
+	n := len(sortedNodes)
+	for i, node := range sortedNodes {
+		if node.NodeID != nodeID {
+			continue
+		}
+
+		if i > 0 {
+			prev := sortedNodes[i-1].Hash
+			if prev == node.Hash {
+				return nil
+			}
+			return []HashRange{{Begin: prev + 1, End: node.Hash}}
+		}
+
+		// wrap around
+		result := []HashRange{{Begin: 0, End: node.Hash}}
+		last := sortedNodes[n-1].Hash
+		if last != math.MaxUint32 {
+			result = append(result, HashRange{Begin: last + 1, End: math.MaxUint32})
+		}
+		return result
+	}
+	return nil
+}
+
+// RangesContain checks whether the hash is in one of the ranges
+func RangesContain(ranges []HashRange, hash Hash) bool {
+	for _, r := range ranges {
+		if r.Begin <= hash && hash <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+func subtractRange(r HashRange, sub HashRange) []HashRange {
+	if sub.End < r.Begin || sub.Begin > r.End {
+		return []HashRange{r}
+	}
+
+	var result []HashRange
+	if sub.Begin > r.Begin {
+		result = append(result, HashRange{Begin: r.Begin, End: sub.Begin - 1})
+	}
+	if sub.End < r.End {
+		result = append(result, HashRange{Begin: sub.End + 1, End: r.End})
+	}
+	return result
+}
+
+// SubtractRanges returns the parts of ranges a not in ranges b, sorted by Begin
+func SubtractRanges(a []HashRange, b []HashRange) []HashRange {
+	result := append([]HashRange(nil), a...)
+	for _, sub := range b {
+		next := make([]HashRange, 0, len(result))
+		for _, r := range result {
+			next = append(next, subtractRange(r, sub)...)
+		}
+		result = next
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Begin < result[j].Begin
+	})
+	return result
+}
+
+// IntersectRanges returns the parts of ranges inside r, keeping the order
+func IntersectRanges(ranges []HashRange, r HashRange) []HashRange {
+	var result []HashRange
+	for _, x := range ranges {
+		if x.End < r.Begin || x.Begin > r.End {
+			continue
+		}
+
+		begin := x.Begin
+		if r.Begin > begin {
+			begin = r.Begin
+		}
+		end := x.End
+		if r.End < end {
+			end = r.End
+		}
+		result = append(result, HashRange{Begin: begin, End: end})
+	}
+	return result
+}
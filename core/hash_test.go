@@ -1,6 +1,7 @@
 package core
 
 import (
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -176,6 +177,57 @@ func TestGetNodeAddress(t *testing.T) {
 	}
 }
 
+func TestGetNextNodes(t *testing.T) {
+	nodes := []NodeInfo{
+		{NodeID: 1, Hash: 100, Address: "node1"},
+		{NodeID: 2, Hash: 200, Address: "node2"},
+		{NodeID: 3, Hash: 300, Address: "node2"},
+		{NodeID: 4, Hash: 400, Address: "node4"},
+	}
+
+	table := []struct {
+		name     string
+		nodes    []NodeInfo
+		hash     Hash
+		n        int
+		expected []NodeInfo
+	}{
+		{
+			name: "empty",
+			hash: 100,
+			n:    2,
+		},
+		{
+			name:     "owner-and-next",
+			nodes:    nodes,
+			hash:     150,
+			n:        2,
+			expected: []NodeInfo{nodes[1], nodes[3]},
+		},
+		{
+			name:     "wrap-around",
+			nodes:    nodes,
+			hash:     350,
+			n:        2,
+			expected: []NodeInfo{nodes[3], nodes[0]},
+		},
+		{
+			name:     "more-than-nodes",
+			nodes:    nodes,
+			hash:     50,
+			n:        5,
+			expected: []NodeInfo{nodes[0], nodes[1], nodes[3]},
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			result := GetNextNodes(e.nodes, e.hash, e.n)
+			assert.Equal(t, e.expected, result)
+		})
+	}
+}
+
 func TestSort(t *testing.T) {
 	table := []struct {
 		name     string
@@ -263,3 +315,157 @@ func TestSort(t *testing.T) {
 		})
 	}
 }
+
+func TestGetOwnedRanges(t *testing.T) {
+	nodes := []NodeInfo{
+		{NodeID: 3, Hash: 100},
+		{NodeID: 2, Hash: 200},
+		{NodeID: 1, Hash: 200},
+		{NodeID: 4, Hash: 400},
+	}
+
+	table := []struct {
+		name     string
+		nodes    []NodeInfo
+		nodeID   NodeID
+		expected []HashRange
+	}{
+		{
+			name:   "not-existed",
+			nodes:  nodes,
+			nodeID: 5,
+		},
+		{
+			name:   "single",
+			nodes:  []NodeInfo{{NodeID: 1, Hash: 100}},
+			nodeID: 1,
+			expected: []HashRange{
+				{Begin: 0, End: 100},
+				{Begin: 101, End: math.MaxUint32},
+			},
+		},
+		{
+			name:   "first-wrap-around",
+			nodes:  nodes,
+			nodeID: 3,
+			expected: []HashRange{
+				{Begin: 0, End: 100},
+				{Begin: 401, End: math.MaxUint32},
+			},
+		},
+		{
+			name:   "middle",
+			nodes:  nodes,
+			nodeID: 2,
+			expected: []HashRange{
+				{Begin: 101, End: 200},
+			},
+		},
+		{
+			name:   "same-hash",
+			nodes:  nodes,
+			nodeID: 1,
+		},
+		{
+			name: "last-max-hash",
+			nodes: []NodeInfo{
+				{NodeID: 1, Hash: 100},
+				{NodeID: 2, Hash: math.MaxUint32},
+			},
+			nodeID: 1,
+			expected: []HashRange{
+				{Begin: 0, End: 100},
+			},
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			result := GetOwnedRanges(e.nodes, e.nodeID)
+			assert.Equal(t, e.expected, result)
+
+			for _, r := range result {
+				assert.Equal(t, e.nodeID, GetNodeID(e.nodes, r.Begin).NodeID)
+				assert.Equal(t, e.nodeID, GetNodeID(e.nodes, r.End).NodeID)
+			}
+		})
+	}
+}
+
+func TestSubtractRanges(t *testing.T) {
+	table := []struct {
+		name     string
+		a        []HashRange
+		b        []HashRange
+		expected []HashRange
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "no-overlap",
+			a:        []HashRange{{Begin: 10, End: 20}},
+			b:        []HashRange{{Begin: 30, End: 40}},
+			expected: []HashRange{{Begin: 10, End: 20}},
+		},
+		{
+			name: "split",
+			a:    []HashRange{{Begin: 10, End: 50}, {Begin: 0, End: 5}},
+			b:    []HashRange{{Begin: 20, End: 30}},
+			expected: []HashRange{
+				{Begin: 0, End: 5},
+				{Begin: 10, End: 19},
+				{Begin: 31, End: 50},
+			},
+		},
+		{
+			name:     "covered",
+			a:        []HashRange{{Begin: 10, End: 20}},
+			b:        []HashRange{{Begin: 0, End: 15}, {Begin: 16, End: math.MaxUint32}},
+			expected: []HashRange{},
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			result := SubtractRanges(e.a, e.b)
+			assert.Equal(t, e.expected, result)
+		})
+	}
+}
+
+func TestIntersectRanges(t *testing.T) {
+	table := []struct {
+		name     string
+		ranges   []HashRange
+		r        HashRange
+		expected []HashRange
+	}{
+		{
+			name: "empty",
+			r:    HashRange{Begin: 0, End: 10},
+		},
+		{
+			name:   "clipped",
+			ranges: []HashRange{{Begin: 0, End: 15}, {Begin: 30, End: 40}, {Begin: 50, End: 60}},
+			r:      HashRange{Begin: 10, End: 35},
+			expected: []HashRange{
+				{Begin: 10, End: 15},
+				{Begin: 30, End: 35},
+			},
+		},
+		{
+			name:     "inside",
+			ranges:   []HashRange{{Begin: 20, End: 30}},
+			r:        HashRange{Begin: 0, End: math.MaxUint32},
+			expected: []HashRange{{Begin: 20, End: 30}},
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			result := IntersectRanges(e.ranges, e.r)
+			assert.Equal(t, e.expected, result)
+		})
+	}
+}
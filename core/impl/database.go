@@ -99,6 +99,7 @@ func dbNodeInfosToCore(nodes []dbNodeInfo) []core.NodeInfo {
 
 func (c *DBCoreService) watch(ch chan<- core.WatchResponse) {
 	var oldNodes []core.NodeInfo
+	var epoch uint64
 	for {
 		query := `
 SELECT node_id, hash, address FROM consistent_hash
@@ -116,7 +117,9 @@ WHERE NOW() <= expired_at
 		core.Sort(newNodes)
 
 		if !core.Equals(oldNodes, newNodes) {
+			epoch++
 			ch <- core.WatchResponse{
+				Epoch: epoch,
 				Nodes: newNodes,
 			}
 		}
@@ -12,6 +12,13 @@ import (
 	"go.etcd.io/etcd/clientv3"
 )
 
+const (
+	// NodesPrefix is the etcd prefix of nodes of the ring
+	NodesPrefix = "/sharding/"
+	// ProxiesPrefix is the etcd prefix of proxies, not under NodesPrefix
+	ProxiesPrefix = "/sharding-proxies/"
+)
+
 // EtcdCoreService ...
 type EtcdCoreService struct {
 	prefix     string
@@ -20,8 +27,17 @@ type EtcdCoreService struct {
 
 var _ core.Service = &EtcdCoreService{}
 
-// NewEtcdCoreService ...
+// NewEtcdCoreService for nodes of the ring
 func NewEtcdCoreService() *EtcdCoreService {
+	return newEtcdCoreService(NodesPrefix)
+}
+
+// NewEtcdProxyService for the membership of proxies, hashes of proxies are not used
+func NewEtcdProxyService() *EtcdCoreService {
+	return newEtcdCoreService(ProxiesPrefix)
+}
+
+func newEtcdCoreService(prefix string) *EtcdCoreService {
 	cfg := clientv3.Config{
 		Endpoints: []string{
 			"localhost:2379",
@@ -34,7 +50,7 @@ func NewEtcdCoreService() *EtcdCoreService {
 	}
 
 	return &EtcdCoreService{
-		prefix:     "/sharding/",
+		prefix:     prefix,
 		etcdClient: etcdClient,
 	}
 }
@@ -126,6 +142,7 @@ func (s *EtcdCoreService) watch(ctx context.Context, ch chan<- core.WatchRespons
 	}
 	core.Sort(nodes)
 	ch <- core.WatchResponse{
+		Epoch: uint64(getRes.Header.Revision),
 		Nodes: nodes,
 	}
 
@@ -149,6 +166,7 @@ func (s *EtcdCoreService) watch(ctx context.Context, ch chan<- core.WatchRespons
 			}
 
 			ch <- core.WatchResponse{
+				Epoch: uint64(wr.Header.Revision),
 				Nodes: nodes,
 			}
 		}
@@ -128,6 +128,7 @@ func (c *PeerCoreService) watch(ctx context.Context, ch chan<- core.WatchRespons
 	}
 
 	go func() {
+		var epoch uint64
 		for a := range actionChan {
 			if a.action == actionTypeInsert {
 				nodeMap[a.node.NodeID] = a.node
@@ -140,7 +141,9 @@ func (c *PeerCoreService) watch(ctx context.Context, ch chan<- core.WatchRespons
 				nodes = append(nodes, n)
 			}
 			core.Sort(nodes)
+			epoch++
 			ch <- core.WatchResponse{
+				Epoch: epoch,
 				Nodes: nodes,
 			}
 		}
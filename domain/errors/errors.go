@@ -65,6 +65,15 @@ func New(code, msg string) error {
 	}
 }
 
+// Status converts err to a gRPC status, keeps the code of status errors
+func Status(err error) *status.Status {
+	domainErr, ok := err.(domainErr)
+	if !ok {
+		return status.Convert(err)
+	}
+	return status.New(domainErr.rpcCode, domainErr.Error())
+}
+
 // UnaryServerInterceptor creates a server interceptor
 func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
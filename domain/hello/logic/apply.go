@@ -0,0 +1,234 @@
+package logic
+
+import (
+	"sharding/core"
+	"sharding/domain/hello"
+	"sharding/statemachine"
+	"time"
+)
+
+const maxBatchSize = 5000
+
+// counterDomain is the logic of counters hosted by statemachine.NewStore
+type counterDomain struct{}
+
+var _ statemachine.Domain = counterDomain{}
+
+// Hash ...
+func (counterDomain) Hash(key statemachine.Key) core.Hash {
+	return hashCounterID(hello.CounterID(key))
+}
+
+// NewEntity ...
+func (counterDomain) NewEntity(key statemachine.Key, version uint32) statemachine.Entity {
+	return hello.Counter{
+		ID:      hello.CounterID(key),
+		Version: version,
+	}
+}
+
+// Apply ...
+func (counterDomain) Apply(state *statemachine.State, cmds []statemachine.Command) []statemachine.Event {
+	events := make([]statemachine.Event, 0, len(cmds))
+	for _, cmd := range cmds {
+		events = append(events, applyCommand(state, cmd.(command)))
+	}
+	return events
+}
+
+func getCounter(state *statemachine.State, id hello.CounterID) hello.Counter {
+	return state.Get(statemachine.Key(id)).(hello.Counter)
+}
+
+func applyCommand(state *statemachine.State, cmd command) event {
+	now := state.Now()
+
+	switch cmd.Type() {
+	case commandTypeInc:
+		cmdInc := cmd.(commandInc)
+
+		oldCounter := getCounter(state, cmdInc.counterID)
+		if !counterKindMatched(oldCounter, hello.CounterKindPlain) {
+			return eventInc{err: hello.ErrCounterKindMismatched}
+		}
+
+		applied := findAppliedRequest(oldCounter.Requests, cmdInc.requestID)
+		if applied.Valid {
+			return eventInc{value: applied.Value}
+		}
+
+		newCounter := oldCounter
+		newCounter.Value = oldCounter.Value + 1
+		newCounter.Requests = appendAppliedRequest(oldCounter.Requests, hello.AppliedRequest{
+			RequestID: cmdInc.requestID,
+			Value:     newCounter.Value,
+		})
+		if cmdInc.ttl > 0 {
+			newCounter.ExpiredAt = now.Add(cmdInc.ttl)
+		}
+		state.Put(newCounter)
+
+		return eventInc{value: newCounter.Value}
+
+	case commandTypeCheckAndInc:
+		cmdCheck := cmd.(commandCheckAndInc)
+
+		oldCounter := getCounter(state, cmdCheck.counterID)
+		if !counterKindMatched(oldCounter, hello.CounterKindWindow) {
+			return eventCheckAndInc{err: hello.ErrCounterKindMismatched}
+		}
+
+		// only allowed requests are kept, denied ones change nothing when retried
+		applied := findAppliedRequest(oldCounter.Requests, cmdCheck.requestID)
+		if applied.Valid {
+			return eventCheckAndInc{
+				allowed: true,
+				count:   applied.Value,
+			}
+		}
+
+		res := checkAndIncreaseWindow(oldCounter, windowLimit{
+			limit:   cmdCheck.limit,
+			window:  cmdCheck.window,
+			sliding: cmdCheck.sliding,
+		}, now)
+		if res.allowed {
+			res.counter.Requests = appendAppliedRequest(res.counter.Requests, hello.AppliedRequest{
+				RequestID: cmdCheck.requestID,
+				Value:     res.count,
+			})
+		}
+		if res.changed {
+			state.Put(res.counter)
+		}
+
+		return eventCheckAndInc{
+			allowed: res.allowed,
+			count:   res.count,
+		}
+
+	case commandTypeGet:
+		cmdGet := cmd.(commandGet)
+
+		c := getCounter(state, cmdGet.counterID)
+		if !counterKindMatched(c, hello.CounterKindPlain) {
+			return eventGet{err: hello.ErrCounterKindMismatched}
+		}
+
+		return eventGet{value: c.Value}
+
+	case commandTypeDelete:
+		cmdDelete := cmd.(commandDelete)
+
+		state.Delete(statemachine.Key(cmdDelete.counterID))
+
+		return eventDelete{}
+
+	default:
+		panic("Invalid command type")
+	}
+}
+
+// EncodeEntity ...
+func (counterDomain) EncodeEntity(e *statemachine.Encoder, entity statemachine.Entity) {
+	c := entity.(hello.Counter)
+	e.Uint32(uint32(c.ID))
+	e.Uint8(uint8(c.Kind))
+	e.Uint32(c.Version)
+	e.Uint32(c.Value)
+	e.Time(c.ExpiredAt)
+	e.Time(c.WindowStart)
+	e.Uint32(c.PrevValue)
+
+	e.Uint16(uint16(len(c.Requests)))
+	for _, r := range c.Requests {
+		e.ShortString(string(r.RequestID))
+		e.Uint32(r.Value)
+	}
+}
+
+// DecodeEntity ...
+func (counterDomain) DecodeEntity(d *statemachine.Decoder) statemachine.Entity {
+	c := hello.Counter{
+		ID:          hello.CounterID(d.Uint32()),
+		Kind:        hello.CounterKind(d.Uint8()),
+		Version:     d.Uint32(),
+		Value:       d.Uint32(),
+		ExpiredAt:   d.Time(),
+		WindowStart: d.Time(),
+		PrevValue:   d.Uint32(),
+	}
+
+	n := d.Uint16()
+	if n > 0 && d.Err() == nil {
+		c.Requests = make([]hello.AppliedRequest, 0, n)
+	}
+	for i := uint16(0); i < n && d.Err() == nil; i++ {
+		c.Requests = append(c.Requests, hello.AppliedRequest{
+			RequestID: hello.RequestID(d.ShortString()),
+			Value:     d.Uint32(),
+		})
+	}
+	return c
+}
+
+// EntitySize estimates the size of a counter row in bytes
+func (counterDomain) EntitySize(entity statemachine.Entity) int {
+	c := entity.(hello.Counter)
+	size := 40
+	for _, r := range c.Requests {
+		size += len(r.RequestID) + 4
+	}
+	return size
+}
+
+func counterExpired(c hello.Counter, now time.Time) bool {
+	return !c.ExpiredAt.IsZero() && !now.Before(c.ExpiredAt)
+}
+
+// counterKindMatched returns true for unused counters of any kind
+func counterKindMatched(c hello.Counter, kind hello.CounterKind) bool {
+	if c.Kind == kind {
+		return true
+	}
+	return c.Value == 0 && c.PrevValue == 0
+}
+
+type nullAppliedRequest struct {
+	Valid bool
+	Value uint32
+}
+
+func findAppliedRequest(requests []hello.AppliedRequest, requestID hello.RequestID) nullAppliedRequest {
+	if requestID == "" {
+		return nullAppliedRequest{}
+	}
+	for _, r := range requests {
+		if r.RequestID == requestID {
+			return nullAppliedRequest{
+				Valid: true,
+				Value: r.Value,
+			}
+		}
+	}
+	return nullAppliedRequest{}
+}
+
+// appendAppliedRequest returns a new slice, the old one can be shared by the state
+func appendAppliedRequest(requests []hello.AppliedRequest, r hello.AppliedRequest) []hello.AppliedRequest {
+	if r.RequestID == "" {
+		return requests
+	}
+
+	if len(requests) >= hello.MaxAppliedRequests {
+		requests = requests[len(requests)-hello.MaxAppliedRequests+1:]
+	}
+
+	result := make([]hello.AppliedRequest, 0, len(requests)+1)
+	result = append(result, requests...)
+	return append(result, r)
+}
+
+func hashCounterID(counterID hello.CounterID) core.Hash {
+	return core.HashUint32(uint32(counterID))
+}
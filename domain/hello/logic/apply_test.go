@@ -0,0 +1,231 @@
+package logic
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sharding/domain/hello"
+	"sharding/statemachine"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCounterState(now time.Time, counters ...hello.Counter,
+) (*statemachine.State, map[statemachine.Key]statemachine.Entity) {
+	entities := make(map[statemachine.Key]statemachine.Entity)
+	for _, c := range counters {
+		entities[c.EntityKey()] = c
+	}
+	return statemachine.NewState(now, counterDomain{}.NewEntity, entities), entities
+}
+
+func TestCounterDomain_ApplyDeduplication(t *testing.T) {
+	state, entities := newCounterState(time.Now(), hello.Counter{
+		ID:      10,
+		Version: 3,
+		Value:   7,
+		Requests: []hello.AppliedRequest{
+			{RequestID: "req-1", Value: 7},
+		},
+	})
+
+	events := counterDomain{}.Apply(state, []statemachine.Command{
+		commandInc{counterID: 10, requestID: "req-1"},
+		commandInc{counterID: 10, requestID: "req-2"},
+		commandInc{counterID: 10, requestID: "req-2"},
+		commandInc{counterID: 10},
+	})
+
+	var values []uint32
+	for _, e := range events {
+		values = append(values, e.(eventInc).value)
+	}
+	assert.Equal(t, []uint32{7, 8, 8, 9}, values)
+
+	assert.Equal(t, hello.Counter{
+		ID:      10,
+		Version: 3,
+		Value:   9,
+		Requests: []hello.AppliedRequest{
+			{RequestID: "req-1", Value: 7},
+			{RequestID: "req-2", Value: 8},
+		},
+	}, entities[10])
+}
+
+func TestCounterDomain_ApplyDeleteAndExpired(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	state, entities := newCounterState(now,
+		hello.Counter{ID: 10, Version: 3, Value: 7},
+		hello.Counter{ID: 11, Version: 5, Value: 2, ExpiredAt: now},
+		hello.Counter{ID: 12, Version: 1, Value: 4},
+	)
+
+	counterDomain{}.Apply(state, []statemachine.Command{
+		commandDelete{counterID: 10},
+		commandInc{counterID: 10},
+		commandInc{counterID: 11, ttl: time.Minute},
+		commandDelete{counterID: 12},
+	})
+
+	assert.Equal(t, map[statemachine.Key]statemachine.Entity{
+		10: hello.Counter{ID: 10, Version: 3, Value: 1},
+		11: hello.Counter{ID: 11, Version: 5, Value: 1, ExpiredAt: now.Add(time.Minute)},
+	}, state.Updates())
+	assert.Equal(t, map[statemachine.Key]uint32{12: 1}, state.Deletes())
+
+	assert.Equal(t, state.Updates(), entities)
+}
+
+func TestAppendAppliedRequest_Bounded(t *testing.T) {
+	var requests []hello.AppliedRequest
+	for i := 0; i < hello.MaxAppliedRequests+5; i++ {
+		requests = appendAppliedRequest(requests, hello.AppliedRequest{
+			RequestID: hello.RequestID(fmt.Sprintf("req-%d", i)),
+			Value:     uint32(i),
+		})
+	}
+
+	assert.Equal(t, hello.MaxAppliedRequests, len(requests))
+	assert.Equal(t, uint32(5), requests[0].Value)
+	assert.Equal(t, uint32(hello.MaxAppliedRequests+4), requests[len(requests)-1].Value)
+}
+
+func TestCounterDomain_ApplyCheckAndIncreaseDeduplication(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 10, 0, time.UTC)
+	state, entities := newCounterState(now)
+
+	check := func(requestID hello.RequestID) commandCheckAndInc {
+		return commandCheckAndInc{counterID: 10, requestID: requestID, limit: 2, window: time.Minute}
+	}
+	events := counterDomain{}.Apply(state, []statemachine.Command{
+		check("req-1"),
+		check("req-1"),
+		check("req-2"),
+		check("req-3"),
+		check("req-2"),
+	})
+
+	assert.Equal(t, []statemachine.Event{
+		eventCheckAndInc{allowed: true, count: 1},
+		eventCheckAndInc{allowed: true, count: 1},
+		eventCheckAndInc{allowed: true, count: 2},
+		eventCheckAndInc{allowed: false, count: 2},
+		eventCheckAndInc{allowed: true, count: 2},
+	}, events)
+	assert.Equal(t, uint32(2), entities[10].(hello.Counter).Value)
+}
+
+func TestCounterDomain_EncodeEntity(t *testing.T) {
+	counter := hello.Counter{
+		ID:      10,
+		Kind:    hello.CounterKindWindow,
+		Version: 3,
+		Value:   7,
+		Requests: []hello.AppliedRequest{
+			{RequestID: "req-1", Value: 6},
+		},
+		ExpiredAt:   time.Unix(1600000000, 0),
+		WindowStart: time.Unix(1599999940, 0),
+		PrevValue:   2,
+	}
+
+	e := &statemachine.Encoder{}
+	counterDomain{}.EncodeEntity(e, counter)
+	counterDomain{}.EncodeEntity(e, counterDomain{}.NewEntity(11, 5))
+
+	d := statemachine.NewDecoder(e.Bytes())
+	assert.Equal(t, counter, counterDomain{}.DecodeEntity(d))
+	assert.Equal(t, hello.Counter{ID: 11, Version: 5}, counterDomain{}.DecodeEntity(d))
+	assert.Equal(t, nil, d.Err())
+}
+
+// walWrittenBeforeExtraction is a WAL segment written by the processor before it was moved
+// into the statemachine package, with an update of the counter of TestCounterDomain_EncodeEntity
+// and a deletion of counter 11 at version 5
+const walWrittenBeforeExtraction = "330000000ab49f7101000000000a0000000103000000070000000000a0d885573416" +
+	"00a858e07757341602000000010005007265712d310600000028000000578bad5f01000000010b0000000005000000" +
+	"0000000000000000000000000000000000000000000000000000"
+
+func TestCounterDomain_ReplayWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.Equal(t, nil, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	data, err := hex.DecodeString(walWrittenBeforeExtraction)
+	assert.Equal(t, nil, err)
+	err = os.MkdirAll(filepath.Join(dir, "node-1"), 0755)
+	assert.Equal(t, nil, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "node-1", "wal-0000000000000001.log"), data, 0644)
+	assert.Equal(t, nil, err)
+
+	// both changes were not yet persisted
+	tx := &fakeTx{}
+	repo := &fakeRepo{
+		counters: []hello.Counter{
+			{ID: 10, Kind: hello.CounterKindWindow, Version: 3, Value: 5},
+			{ID: 11, Version: 5, Value: 2},
+		},
+		tx: tx,
+	}
+	shard := statemachine.Shard{NodeID: 1, Index: 0, Count: 1}
+	sm := statemachine.NewStore(shard, statemachine.StoreConfig{
+		CacheSize:   10,
+		WriteBehind: true,
+		WALDir:      dir,
+	}, counterDomain{}, counterRepo{repo: repo})
+
+	err = sm.Init(context.Background())
+	assert.Equal(t, nil, err)
+	// flushes the replayed changes
+	err = sm.Stop(nil)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, []hello.CounterUpsert{
+		{
+			ID:         10,
+			Hash:       hashCounterID(10),
+			Kind:       hello.CounterKindWindow,
+			NewVersion: 4,
+			Value:      7,
+			Requests: []hello.AppliedRequest{
+				{RequestID: "req-1", Value: 6},
+			},
+			ExpiredAt:   time.Unix(1600000000, 0),
+			WindowStart: time.Unix(1599999940, 0),
+			PrevValue:   2,
+		},
+	}, tx.upserts)
+	assert.Equal(t, []hello.CounterDelete{{ID: 11, Version: 5}}, tx.deletes)
+}
+
+func TestCounterDomain_ApplyGet(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	state, _ := newCounterState(now,
+		hello.Counter{ID: 10, Version: 3, Value: 7},
+		hello.Counter{ID: 11, Version: 1, Value: 2, ExpiredAt: now},
+		hello.Counter{ID: 12, Version: 1, Kind: hello.CounterKindWindow, Value: 1},
+	)
+
+	events := counterDomain{}.Apply(state, []statemachine.Command{
+		commandGet{counterID: 10},
+		commandGet{counterID: 11},
+		commandGet{counterID: 12},
+		commandGet{counterID: 13},
+	})
+
+	assert.Equal(t, []statemachine.Event{
+		eventGet{value: 7},
+		eventGet{value: 0},
+		eventGet{err: hello.ErrCounterKindMismatched},
+		eventGet{value: 0},
+	}, events)
+	assert.Equal(t, 0, len(state.Updates()))
+}
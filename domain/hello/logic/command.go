@@ -0,0 +1,179 @@
+package logic
+
+import (
+	"sharding/core"
+	"sharding/domain/hello"
+	"sharding/statemachine"
+	"time"
+)
+
+type eventType uint32
+type commandType uint32
+
+const (
+	commandTypeInc    commandType = 1
+	commandTypeDelete commandType = 2
+
+	commandTypeCheckAndInc commandType = 3
+	commandTypeGet         commandType = 4
+)
+
+const (
+	eventTypeInc    eventType = 1
+	eventTypeDelete eventType = 2
+
+	eventTypeCheckAndInc eventType = 3
+	eventTypeGet         eventType = 4
+)
+
+type command interface {
+	statemachine.Command
+	Type() commandType
+	CounterID() hello.CounterID
+}
+
+type event interface {
+	Type() eventType
+}
+
+// COMMANDS
+
+type commandInc struct {
+	counterID hello.CounterID
+	requestID hello.RequestID
+	ttl       time.Duration
+}
+
+var _ command = commandInc{}
+
+func (c commandInc) Hash() core.Hash {
+	return hashCounterID(c.counterID)
+}
+
+func (c commandInc) Key() statemachine.Key {
+	return statemachine.Key(c.counterID)
+}
+
+func (c commandInc) CounterID() hello.CounterID {
+	return c.counterID
+}
+
+func (c commandInc) Type() commandType {
+	return commandTypeInc
+}
+
+type commandDelete struct {
+	counterID hello.CounterID
+}
+
+var _ command = commandDelete{}
+
+func (c commandDelete) Hash() core.Hash {
+	return hashCounterID(c.counterID)
+}
+
+func (c commandDelete) Key() statemachine.Key {
+	return statemachine.Key(c.counterID)
+}
+
+func (c commandDelete) CounterID() hello.CounterID {
+	return c.counterID
+}
+
+func (c commandDelete) Type() commandType {
+	return commandTypeDelete
+}
+
+type commandCheckAndInc struct {
+	counterID hello.CounterID
+	requestID hello.RequestID
+	limit     uint32
+	window    time.Duration
+	sliding   bool
+}
+
+var _ command = commandCheckAndInc{}
+
+func (c commandCheckAndInc) Hash() core.Hash {
+	return hashCounterID(c.counterID)
+}
+
+func (c commandCheckAndInc) Key() statemachine.Key {
+	return statemachine.Key(c.counterID)
+}
+
+func (c commandCheckAndInc) CounterID() hello.CounterID {
+	return c.counterID
+}
+
+func (c commandCheckAndInc) Type() commandType {
+	return commandTypeCheckAndInc
+}
+
+type commandGet struct {
+	counterID hello.CounterID
+}
+
+var _ command = commandGet{}
+
+func (c commandGet) Hash() core.Hash {
+	return hashCounterID(c.counterID)
+}
+
+func (c commandGet) Key() statemachine.Key {
+	return statemachine.Key(c.counterID)
+}
+
+func (c commandGet) CounterID() hello.CounterID {
+	return c.counterID
+}
+
+func (c commandGet) Type() commandType {
+	return commandTypeGet
+}
+
+// EVENTS
+
+type eventInc struct {
+	value uint32
+	err   error
+}
+
+var _ event = eventInc{}
+
+func (e eventInc) Type() eventType {
+	return eventTypeInc
+}
+
+type eventDelete struct {
+	err error
+}
+
+var _ event = eventDelete{}
+
+func (e eventDelete) Type() eventType {
+	return eventTypeDelete
+}
+
+type eventCheckAndInc struct {
+	allowed bool
+	count   uint32
+	err     error
+}
+
+var _ event = eventCheckAndInc{}
+
+func (e eventCheckAndInc) Type() eventType {
+	return eventTypeCheckAndInc
+}
+
+type eventGet struct {
+	value uint32
+	err   error
+}
+
+var _ event = eventGet{}
+
+func (e eventGet) Type() eventType {
+	return eventTypeGet
+}
@@ -5,49 +5,173 @@ import (
 	"sharding/config"
 	"sharding/core"
 	"sharding/domain/hello"
+	"sharding/statemachine"
 	"time"
 )
 
 // Port an impl of Port interface
 type Port struct {
-	processor   *processor
-	commandChan chan<- command
+	runtime *statemachine.Runtime
+	repo    hello.Repository
 }
 
 var _ hello.Port = &Port{}
 
 // NewPort creates a Port
-func NewPort(nodeConfig config.NodeConfig, repo hello.Repository) *Port {
-	cmdChan := make(chan command, maxBatchSize*2)
+func NewPort(nodeConfig config.NodeConfig, processorConfig config.ProcessorConfig,
+	repo hello.Repository,
+) *Port {
+	shardCount := processorConfig.Shards
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	storeConfig := statemachine.StoreConfig{
+		Name: "hello",
+		// the cache size is for the whole node
+		CacheSize: processorConfig.CacheSize / shardCount,
+
+		WriteBehind:   processorConfig.Durability == config.DurabilityWriteBehind,
+		FlushInterval: processorConfig.FlushInterval,
+		WALDir:        processorConfig.WALDir,
+
+		SnapshotDir:      processorConfig.SnapshotDir,
+		SnapshotInterval: processorConfig.SnapshotInterval,
+
+		ExpireInterval:      processorConfig.ExpireInterval,
+		ExpireSweepInterval: processorConfig.ExpireSweepInterval,
+	}
+
+	var batchDelay time.Duration
+	if processorConfig.Durability == config.DurabilityGroupCommit {
+		batchDelay = processorConfig.GroupCommitDelay
+	}
+
+	runtime := statemachine.NewRuntime(statemachine.Config{
+		Name:       "hello",
+		SelfNodeID: nodeConfig.ID,
+		Shards:     shardCount,
+
+		MaxBatchSize: maxBatchSize,
+		BatchDelay:   batchDelay,
+
+		CommandTimeout: processorConfig.CommandTimeout,
+		MaxQueueDepth:  processorConfig.MaxQueueDepth,
+		MaxQueueWait:   processorConfig.MaxQueueWait,
+	}, func(shard statemachine.Shard) statemachine.StateMachine {
+		return statemachine.NewStore(shard, storeConfig, counterDomain{}, counterRepo{repo: repo})
+	})
+
 	return &Port{
-		processor:   newProcessor(nodeConfig.ID, repo, cmdChan),
-		commandChan: cmdChan,
+		runtime: runtime,
+		repo:    repo,
 	}
 }
 
 // Increase ...
-func (p *Port) Increase(ctx context.Context, id hello.CounterID) error {
-	replyChan := make(chan event, 1)
+func (p *Port) Increase(ctx context.Context, input hello.IncreaseInput) (uint32, error) {
+	e, err := p.runtime.Execute(ctx, commandInc{
+		counterID: input.CounterID,
+		requestID: input.RequestID,
+		ttl:       input.TTL,
+	})
+	if err != nil {
+		return 0, err
+	}
 
-	p.commandChan <- commandInc{
-		counterID: id,
-		replyChan: replyChan,
+	ev := e.(eventInc)
+	return ev.value, ev.err
+}
+
+// CheckAndIncrease ...
+func (p *Port) CheckAndIncrease(ctx context.Context, input hello.CheckAndIncreaseInput,
+) (hello.CheckAndIncreaseOutput, error) {
+	if input.Limit == 0 || input.Window <= 0 {
+		return hello.CheckAndIncreaseOutput{}, hello.ErrInvalidArgument
+	}
+
+	e, err := p.runtime.Execute(ctx, commandCheckAndInc{
+		counterID: input.CounterID,
+		requestID: input.RequestID,
+		limit:     input.Limit,
+		window:    input.Window,
+		sliding:   input.Sliding,
+	})
+	if err != nil {
+		return hello.CheckAndIncreaseOutput{}, err
 	}
 
-	select {
-	case e, more := <-replyChan:
-		if !more {
-			return hello.ErrInternal
+	ev := e.(eventCheckAndInc)
+	return hello.CheckAndIncreaseOutput{
+		Allowed: ev.allowed,
+		Count:   ev.count,
+	}, ev.err
+}
+
+// Get reads through the owner shard, or from the database if not owned and stale reads allowed
+func (p *Port) Get(ctx context.Context, input hello.GetInput) (hello.GetOutput, error) {
+	if !p.runtime.IsOwner(hashCounterID(input.CounterID)) {
+		if input.AllowStale {
+			return p.getStale(ctx, input.CounterID)
 		}
-		ev := e.(eventInc)
-		return ev.err
+		return hello.GetOutput{}, hello.ErrNotOwner
+	}
+
+	// the shard may have a different view of the ring
+	e, err := p.runtime.Execute(ctx, commandGet{
+		counterID: input.CounterID,
+	})
+	if err == hello.ErrNotOwner && input.AllowStale {
+		return p.getStale(ctx, input.CounterID)
+	}
+	if err != nil {
+		return hello.GetOutput{}, err
+	}
+
+	ev := e.(eventGet)
+	return hello.GetOutput{
+		Value: ev.value,
+	}, ev.err
+}
+
+// getStale misses the changes not yet persisted by the owner
+func (p *Port) getStale(ctx context.Context, id hello.CounterID) (hello.GetOutput, error) {
+	counters, err := p.repo.GetCounters(ctx, []hello.CounterID{id})
+	if err != nil {
+		return hello.GetOutput{}, err
+	}
 
-	case <-time.After(10 * time.Second):
-		return hello.ErrCommandTimeout
+	output := hello.GetOutput{Stale: true}
+	if len(counters) == 0 || counterExpired(counters[0], time.Now()) {
+		return output, nil
 	}
+	if !counterKindMatched(counters[0], hello.CounterKindPlain) {
+		return hello.GetOutput{}, hello.ErrCounterKindMismatched
+	}
+
+	output.Value = counters[0].Value
+	return output, nil
+}
+
+// Delete ...
+func (p *Port) Delete(ctx context.Context, id hello.CounterID) error {
+	e, err := p.runtime.Execute(ctx, commandDelete{
+		counterID: id,
+	})
+	if err != nil {
+		return err
+	}
+
+	ev := e.(eventDelete)
+	return ev.err
+}
+
+// Close ...
+func (p *Port) Close() {
+	p.runtime.Close()
 }
 
 // Process ...
 func (p *Port) Process(ctx context.Context, watchChan <-chan core.WatchResponse) error {
-	return p.processor.process(ctx, watchChan)
+	return p.runtime.Process(ctx, watchChan)
 }
@@ -0,0 +1,107 @@
+package logic
+
+import (
+	"context"
+	"sharding/config"
+	"sharding/domain/hello"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRepo struct {
+	hello.Repository
+	counters []hello.Counter
+	// tx is called by Transact
+	tx *fakeTx
+}
+
+func (r *fakeRepo) GetCounters(ctx context.Context, ids []hello.CounterID) ([]hello.Counter, error) {
+	var result []hello.Counter
+	for _, c := range r.counters {
+		for _, id := range ids {
+			if c.ID == id {
+				result = append(result, c)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (r *fakeRepo) Transact(ctx context.Context, fn func(ctx context.Context, tx hello.TxRepository) error) error {
+	return fn(ctx, r.tx)
+}
+
+type fakeTx struct {
+	hello.TxRepository
+	upserts []hello.CounterUpsert
+	deletes []hello.CounterDelete
+}
+
+func (tx *fakeTx) UpsertCounters(ctx context.Context, counters []hello.CounterUpsert) error {
+	tx.upserts = append(tx.upserts, counters...)
+	return nil
+}
+
+func (tx *fakeTx) DeleteCounters(ctx context.Context, counters []hello.CounterDelete) error {
+	tx.deletes = append(tx.deletes, counters...)
+	return nil
+}
+
+func TestPort_GetNotOwned(t *testing.T) {
+	now := time.Now()
+
+	table := []struct {
+		name       string
+		counters   []hello.Counter
+		allowStale bool
+
+		output hello.GetOutput
+		err    error
+	}{
+		{
+			name:   "not-stale",
+			err:    hello.ErrNotOwner,
+			output: hello.GetOutput{},
+		},
+		{
+			name:       "stale",
+			counters:   []hello.Counter{{ID: 10, Version: 2, Value: 7}},
+			allowStale: true,
+			output:     hello.GetOutput{Value: 7, Stale: true},
+		},
+		{
+			name:       "stale-not-existed",
+			allowStale: true,
+			output:     hello.GetOutput{Stale: true},
+		},
+		{
+			name:       "stale-expired",
+			counters:   []hello.Counter{{ID: 10, Version: 2, Value: 7, ExpiredAt: now.Add(-time.Second)}},
+			allowStale: true,
+			output:     hello.GetOutput{Stale: true},
+		},
+		{
+			name:       "stale-kind-mismatched",
+			counters:   []hello.Counter{{ID: 10, Version: 2, Kind: hello.CounterKindWindow, Value: 7}},
+			allowStale: true,
+			err:        hello.ErrCounterKindMismatched,
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			// no nodes were watched, commands are not executed by any shard
+			p := NewPort(config.NodeConfig{ID: 1}, config.ProcessorConfig{CacheSize: 10},
+				&fakeRepo{counters: e.counters})
+
+			output, err := p.Get(context.Background(), hello.GetInput{
+				CounterID:  10,
+				AllowStale: e.allowStale,
+			})
+			assert.Equal(t, e.err, err)
+			assert.Equal(t, e.output, output)
+		})
+	}
+}
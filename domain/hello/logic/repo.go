@@ -0,0 +1,105 @@
+package logic
+
+import (
+	"context"
+	"sharding/core"
+	"sharding/domain/hello"
+	"sharding/statemachine"
+	"time"
+)
+
+// counterRepo adapts hello.Repository to the repository of statemachine.NewStore
+type counterRepo struct {
+	repo hello.Repository
+}
+
+var _ statemachine.Repository = counterRepo{}
+
+type counterTxRepo struct {
+	tx hello.TxRepository
+}
+
+var _ statemachine.TxRepository = counterTxRepo{}
+
+func toEntities(counters []hello.Counter) []statemachine.Entity {
+	result := make([]statemachine.Entity, 0, len(counters))
+	for _, c := range counters {
+		result = append(result, c)
+	}
+	return result
+}
+
+// GetByHashRanges ...
+func (r counterRepo) GetByHashRanges(ctx context.Context, ranges []core.HashRange, limit int,
+) ([]statemachine.Entity, error) {
+	counters, err := r.repo.GetCountersByHashRanges(ctx, ranges, limit)
+	if err != nil {
+		return nil, err
+	}
+	return toEntities(counters), nil
+}
+
+// Get ...
+func (r counterRepo) Get(ctx context.Context, keys []statemachine.Key) ([]statemachine.Entity, error) {
+	ids := make([]hello.CounterID, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, hello.CounterID(key))
+	}
+
+	counters, err := r.repo.GetCounters(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return toEntities(counters), nil
+}
+
+// Transact ...
+func (r counterRepo) Transact(ctx context.Context,
+	fn func(ctx context.Context, tx statemachine.TxRepository) error,
+) error {
+	return r.repo.Transact(ctx, func(ctx context.Context, tx hello.TxRepository) error {
+		return fn(ctx, counterTxRepo{tx: tx})
+	})
+}
+
+func toCounterUpserts(entities []statemachine.Entity) []hello.CounterUpsert {
+	counters := make([]hello.CounterUpsert, 0, len(entities))
+	for _, e := range entities {
+		c := e.(hello.Counter)
+		counters = append(counters, hello.CounterUpsert{
+			ID:          c.ID,
+			Hash:        hashCounterID(c.ID),
+			Kind:        c.Kind,
+			NewVersion:  c.Version + 1,
+			Value:       c.Value,
+			Requests:    c.Requests,
+			ExpiredAt:   c.ExpiredAt,
+			WindowStart: c.WindowStart,
+			PrevValue:   c.PrevValue,
+		})
+	}
+	return counters
+}
+
+// Upsert ...
+func (r counterTxRepo) Upsert(ctx context.Context, entities []statemachine.Entity) error {
+	return r.tx.UpsertCounters(ctx, toCounterUpserts(entities))
+}
+
+// Delete ...
+func (r counterTxRepo) Delete(ctx context.Context, deletes []statemachine.Deletion) error {
+	counters := make([]hello.CounterDelete, 0, len(deletes))
+	for _, d := range deletes {
+		counters = append(counters, hello.CounterDelete{
+			ID:      hello.CounterID(d.Key),
+			Version: d.Version,
+		})
+	}
+	return r.tx.DeleteCounters(ctx, counters)
+}
+
+// DeleteExpired ...
+func (r counterTxRepo) DeleteExpired(ctx context.Context, ranges []core.HashRange, now time.Time, limit int,
+) error {
+	return r.tx.DeleteExpiredCounters(ctx, ranges, now, limit)
+}
@@ -0,0 +1,82 @@
+package logic
+
+import (
+	"sharding/domain/hello"
+	"time"
+)
+
+type windowLimit struct {
+	limit   uint32
+	window  time.Duration
+	sliding bool
+}
+
+type windowResult struct {
+	counter hello.Counter
+	changed bool
+	allowed bool
+	count   uint32
+}
+
+// windowStart returns the start of the window containing now, aligned to the unix epoch
+func windowStart(now time.Time, window time.Duration) time.Time {
+	return time.Unix(0, now.UnixNano()/int64(window)*int64(window))
+}
+
+// rolloverWindow moves the window counter to the window containing now
+func rolloverWindow(c hello.Counter, window time.Duration, now time.Time) hello.Counter {
+	start := windowStart(now, window)
+
+	c.Kind = hello.CounterKindWindow
+	if c.WindowStart.Equal(start) {
+		return c
+	}
+
+	if c.WindowStart.Add(window).Equal(start) {
+		c.PrevValue = c.Value
+	} else {
+		c.PrevValue = 0
+	}
+	c.Value = 0
+	c.WindowStart = start
+	return c
+}
+
+// windowCount computes the count of the current window,
+// a sliding window weights the previous fixed window by its overlapped part
+func windowCount(c hello.Counter, limit windowLimit, now time.Time) uint32 {
+	if !limit.sliding {
+		return c.Value
+	}
+
+	elapsed := now.Sub(c.WindowStart)
+	remaining := limit.window - elapsed
+	prev := uint64(c.PrevValue) * uint64(remaining) / uint64(limit.window)
+	return c.Value + uint32(prev)
+}
+
+func checkAndIncreaseWindow(old hello.Counter, limit windowLimit, now time.Time) windowResult {
+	c := rolloverWindow(old, limit.window, now)
+	changed := old.Kind != c.Kind || !old.WindowStart.Equal(c.WindowStart)
+
+	count := windowCount(c, limit, now)
+	if count >= limit.limit {
+		return windowResult{
+			counter: c,
+			changed: changed,
+			allowed: false,
+			count:   count,
+		}
+	}
+
+	c.Value++
+	// the state is useless after the next window
+	c.ExpiredAt = c.WindowStart.Add(2 * limit.window)
+
+	return windowResult{
+		counter: c,
+		changed: true,
+		allowed: true,
+		count:   count + 1,
+	}
+}
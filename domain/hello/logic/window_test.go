@@ -0,0 +1,92 @@
+package logic
+
+import (
+	"sharding/domain/hello"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckAndIncreaseWindow(t *testing.T) {
+	start := time.Date(2020, 10, 1, 0, 1, 0, 0, time.UTC)
+
+	table := []struct {
+		name    string
+		old     hello.Counter
+		limit   windowLimit
+		now     time.Time
+		allowed bool
+		count   uint32
+		value   uint32
+	}{
+		{
+			name:    "empty",
+			limit:   windowLimit{limit: 2, window: time.Minute},
+			now:     start.Add(10 * time.Second),
+			allowed: true,
+			count:   1,
+			value:   1,
+		},
+		{
+			name: "fixed-reached-limit",
+			old: hello.Counter{
+				Kind: hello.CounterKindWindow, Value: 2, WindowStart: start,
+			},
+			limit:   windowLimit{limit: 2, window: time.Minute},
+			now:     start.Add(10 * time.Second),
+			allowed: false,
+			count:   2,
+			value:   2,
+		},
+		{
+			name: "fixed-next-window",
+			old: hello.Counter{
+				Kind: hello.CounterKindWindow, Value: 2, WindowStart: start,
+			},
+			limit:   windowLimit{limit: 2, window: time.Minute},
+			now:     start.Add(70 * time.Second),
+			allowed: true,
+			count:   1,
+			value:   1,
+		},
+		{
+			name: "sliding-weights-previous-window",
+			old: hello.Counter{
+				Kind: hello.CounterKindWindow, Value: 4, WindowStart: start,
+			},
+			limit:   windowLimit{limit: 3, window: time.Minute, sliding: true},
+			now:     start.Add(75 * time.Second),
+			allowed: false,
+			count:   3,
+			value:   0,
+		},
+		{
+			name: "sliding-after-two-windows",
+			old: hello.Counter{
+				Kind: hello.CounterKindWindow, Value: 4, WindowStart: start,
+			},
+			limit:   windowLimit{limit: 4, window: time.Minute, sliding: true},
+			now:     start.Add(125 * time.Second),
+			allowed: true,
+			count:   1,
+			value:   1,
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			res := checkAndIncreaseWindow(e.old, e.limit, e.now)
+			assert.Equal(t, e.allowed, res.allowed)
+			assert.Equal(t, e.count, res.count)
+			assert.Equal(t, e.value, res.counter.Value)
+			assert.Equal(t, hello.CounterKindWindow, res.counter.Kind)
+		})
+	}
+}
+
+func TestWindowStart_AlignedToUnixEpoch(t *testing.T) {
+	now := time.Unix(1000, 500)
+	assert.Equal(t, int64(994), windowStart(now, 7*time.Second).Unix())
+	assert.Equal(t, int64(960), windowStart(now, time.Minute).Unix())
+}
@@ -4,31 +4,148 @@ import (
 	"context"
 	"sharding/core"
 	"sharding/domain/errors"
+	"sharding/statemachine"
+	"time"
 )
 
 type (
 	// CounterID for counter id
 	CounterID uint32
 
+	// CounterKind for kind of counter
+	CounterKind uint8
+
+	// RequestID is the idempotency key of a request, empty for none
+	RequestID string
+
+	// AppliedRequest keeps the result of an applied request for deduplication
+	AppliedRequest struct {
+		RequestID RequestID
+		Value     uint32
+	}
+
 	// Counter model from db
 	Counter struct {
 		ID      CounterID
+		Kind    CounterKind
 		Version uint32
-		Value   uint32
+		// Value is the count of the current window for window counters
+		Value uint32
+
+		// Requests are the most recent applied requests, oldest first
+		Requests []AppliedRequest
+
+		// ExpiredAt is zero for never expired counters
+		ExpiredAt time.Time
+
+		// WindowStart and PrevValue are only used by window counters
+		WindowStart time.Time
+		PrevValue   uint32
 	}
 
 	// CounterUpsert for upserting
 	CounterUpsert struct {
-		ID         CounterID
-		NewVersion uint32
-		Value      uint32
+		ID          CounterID
+		Hash        core.Hash
+		Kind        CounterKind
+		NewVersion  uint32
+		Value       uint32
+		Requests    []AppliedRequest
+		ExpiredAt   time.Time
+		WindowStart time.Time
+		PrevValue   uint32
+	}
+
+	// CounterDelete for deleting, Version is zero for never stored counters
+	CounterDelete struct {
+		ID      CounterID
+		Version uint32
+	}
+
+	// IncreaseInput input of Increase
+	IncreaseInput struct {
+		CounterID CounterID
+		// RequestID for deduplication, a duplicated request returns the value of the original one
+		RequestID RequestID
+		// TTL refreshes the expiry of the counter, zero for keeping the current one
+		TTL time.Duration
+	}
+
+	// CheckAndIncreaseInput input of CheckAndIncrease
+	CheckAndIncreaseInput struct {
+		CounterID CounterID
+		// RequestID for deduplication, a duplicated request returns the count of the allowed one
+		RequestID RequestID
+		// Limit is the max count per window
+		Limit uint32
+		// Window is the size of a window, windows are aligned to the unix epoch
+		Window time.Duration
+		// Sliding estimates the count of a sliding window using the previous fixed window
+		Sliding bool
+	}
+
+	// GetInput input of Get
+	GetInput struct {
+		CounterID CounterID
+		// AllowStale reads the persisted value if the node is not the owner
+		AllowStale bool
+	}
+
+	// GetOutput output of Get
+	GetOutput struct {
+		Value uint32
+		// Stale is true if read from the database by a node not owning the counter
+		Stale bool
+	}
+
+	// CheckAndIncreaseOutput output of CheckAndIncrease
+	CheckAndIncreaseOutput struct {
+		Allowed bool
+		// Count in the current window, including the increased one if allowed
+		Count uint32
 	}
 )
 
+const (
+	// CounterKindPlain for counters of Increase
+	CounterKindPlain CounterKind = 0
+	// CounterKindWindow for counters of CheckAndIncrease
+	CounterKindWindow CounterKind = 1
+)
+
+// MaxAppliedRequests is the max number of applied requests kept per counter
+const MaxAppliedRequests = 32
+
+var _ statemachine.Entity = Counter{}
+
+// EntityKey ...
+func (c Counter) EntityKey() statemachine.Key {
+	return statemachine.Key(c.ID)
+}
+
+// EntityVersion ...
+func (c Counter) EntityVersion() uint32 {
+	return c.Version
+}
+
+// EntityExpiredAt ...
+func (c Counter) EntityExpiredAt() time.Time {
+	return c.ExpiredAt
+}
+
+// WithEntityVersion ...
+func (c Counter) WithEntityVersion(version uint32) statemachine.Entity {
+	c.Version = version
+	return c
+}
+
 type (
 	// Repository interface for db
 	Repository interface {
-		GetAllCounters(ctx context.Context) ([]Counter, error)
+		// GetCountersByHashRanges returns at most limit counters with hashes in the ranges
+		GetCountersByHashRanges(ctx context.Context, ranges []core.HashRange, limit int) ([]Counter, error)
+		// GetCounters returns existing counters of ids
+		GetCounters(ctx context.Context, ids []CounterID) ([]Counter, error)
 
 		Transact(ctx context.Context, fn func(ctx context.Context, tx TxRepository) error) error
 	}
@@ -36,33 +153,58 @@ type (
 	// TxRepository interface for transactions
 	TxRepository interface {
 		UpsertCounters(ctx context.Context, counters []CounterUpsert) error
+		// DeleteCounters returns ErrCommandAborted if versions are mismatched
+		DeleteCounters(ctx context.Context, counters []CounterDelete) error
+		// DeleteExpiredCounters deletes at most limit counters in the ranges expired at now
+		DeleteExpiredCounters(ctx context.Context, ranges []core.HashRange, now time.Time, limit int) error
 	}
 
 	// Port interface for core logic
 	Port interface {
-		// Increase for increasing counter
-		Increase(ctx context.Context, id CounterID) error
+		// Increase for increasing counter, returns the value after increasing
+		Increase(ctx context.Context, input IncreaseInput) (uint32, error)
+		// CheckAndIncrease increases the window counter if its count is below the limit
+		CheckAndIncrease(ctx context.Context, input CheckAndIncreaseInput) (CheckAndIncreaseOutput, error)
+		// Get returns the value of a counter of Increase
+		Get(ctx context.Context, input GetInput) (GetOutput, error)
+		// Delete for deleting counter
+		Delete(ctx context.Context, id CounterID) error
 		// Process process in background
 		Process(ctx context.Context, watchChan <-chan core.WatchResponse) error
+		// Close rejects new commands with ErrNotOwner, queued commands are still processed
+		// when the context of Process is done
+		Close()
 	}
 )
 
 var (
 	// ErrCommandAborted ...
-	ErrCommandAborted = errors.New("10000", "Command aborted")
+	ErrCommandAborted = statemachine.ErrCommandAborted
 
 	// ErrCommandTimeout ...
-	ErrCommandTimeout = errors.New("10001", "Command timeout")
+	ErrCommandTimeout = statemachine.ErrCommandTimeout
 
 	// ErrClientAborted ...
-	ErrClientAborted = errors.New("10002", "Client aborted")
+	ErrClientAborted = statemachine.ErrClientAborted
+
+	// ErrNotOwner is returned for counters owned by other nodes, retried by proxies
+	ErrNotOwner = statemachine.ErrNotOwner
+
+	// ErrInvalidArgument ...
+	ErrInvalidArgument = errors.New("03001", "Invalid argument")
+
+	// ErrCounterKindMismatched ...
+	ErrCounterKindMismatched = errors.New("09001", "Counter kind mismatched")
+
+	// ErrTooManyRequests ...
+	ErrTooManyRequests = statemachine.ErrTooManyRequests
 
 	// ErrServiceUnavailable ...
-	ErrServiceUnavailable = errors.New("14001", "Service unavailable")
+	ErrServiceUnavailable = statemachine.ErrServiceUnavailable
 
 	// ErrInternal ...
-	ErrInternal = errors.New("13001", "Internal server error")
+	ErrInternal = statemachine.ErrInternal
 
 	// ErrShardingConfig ...
-	ErrShardingConfig = errors.New("13002", "Sharding configure problem")
+	ErrShardingConfig = statemachine.ErrShardingConfig
 )
@@ -0,0 +1,16 @@
+-- Tables used before counters were partitioned by hash ranges
+
+CREATE TABLE IF NOT EXISTS counter (
+    id INT UNSIGNED NOT NULL,
+    version INT UNSIGNED NOT NULL,
+    value INT UNSIGNED NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS consistent_hash (
+    node_id INT UNSIGNED NOT NULL,
+    hash INT UNSIGNED NOT NULL,
+    address VARCHAR(255) NOT NULL,
+    expired_at DATETIME NOT NULL,
+    PRIMARY KEY (node_id)
+);
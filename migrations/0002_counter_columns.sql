@@ -0,0 +1,15 @@
+-- Columns of idempotency keys, expiry, window counters and hash ranges.
+--
+-- hash is nullable until existing rows are backfilled by cmd/migrate,
+-- nodes must be stopped until 0003 is applied, rows without hash are not loaded by range.
+
+ALTER TABLE counter
+    ADD COLUMN hash INT UNSIGNED NULL AFTER id,
+    ADD COLUMN kind TINYINT UNSIGNED NOT NULL DEFAULT 0 AFTER hash,
+    ADD COLUMN requests JSON NULL,
+    ADD COLUMN expired_at DATETIME(6) NULL,
+    ADD COLUMN window_start DATETIME(6) NULL,
+    ADD COLUMN prev_value INT UNSIGNED NOT NULL DEFAULT 0,
+    ADD COLUMN updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    -- loading counters of owned ranges and deleting expired ones
+    ADD INDEX idx_counter_hash_expired_at (hash, expired_at);
@@ -0,0 +1,4 @@
+-- Applied after all rows were backfilled by cmd/migrate
+
+ALTER TABLE counter
+    MODIFY COLUMN hash INT UNSIGNED NOT NULL;
@@ -2,9 +2,13 @@ package hello
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sharding/core"
 	"sharding/domain/hello"
 	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -31,33 +35,167 @@ func NewRepo(db *sqlx.DB) *Repo {
 }
 
 type selectCounter struct {
-	ID      hello.CounterID `db:"id"`
-	Version uint32          `db:"version"`
-	Value   uint32          `db:"value"`
+	ID          hello.CounterID   `db:"id"`
+	Kind        hello.CounterKind `db:"kind"`
+	Version     uint32            `db:"version"`
+	Value       uint32            `db:"value"`
+	Requests    []byte            `db:"requests"`
+	ExpiredAt   sql.NullTime      `db:"expired_at"`
+	WindowStart sql.NullTime      `db:"window_start"`
+	PrevValue   uint32            `db:"prev_value"`
 }
 
-// GetAllCounters ...
-func (r *Repo) GetAllCounters(ctx context.Context) ([]hello.Counter, error) {
-	query := `SELECT id, version, value FROM counter`
+type appliedRequest struct {
+	RequestID hello.RequestID `json:"id"`
+	Value     uint32          `json:"value"`
+}
 
-	var counters []selectCounter
-	err := r.db.SelectContext(ctx, &counters, query)
+func encodeAppliedRequests(requests []hello.AppliedRequest) ([]byte, error) {
+	list := make([]appliedRequest, 0, len(requests))
+	for _, r := range requests {
+		list = append(list, appliedRequest{
+			RequestID: r.RequestID,
+			Value:     r.Value,
+		})
+	}
+	return json.Marshal(list)
+}
+
+func toNullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{
+		Valid: !t.IsZero(),
+		Time:  t,
+	}
+}
+
+func decodeAppliedRequests(data []byte) ([]hello.AppliedRequest, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var list []appliedRequest
+	err := json.Unmarshal(data, &list)
 	if err != nil {
 		return nil, err
 	}
 
+	result := make([]hello.AppliedRequest, 0, len(list))
+	for _, r := range list {
+		result = append(result, hello.AppliedRequest{
+			RequestID: r.RequestID,
+			Value:     r.Value,
+		})
+	}
+	return result, nil
+}
+
+const selectCounterColumns = `id, kind, version, value, requests, expired_at, window_start, prev_value`
+
+func toCounters(counters []selectCounter) ([]hello.Counter, error) {
 	result := make([]hello.Counter, 0, len(counters))
 	for _, c := range counters {
+		requests, err := decodeAppliedRequests(c.Requests)
+		if err != nil {
+			return nil, err
+		}
+
 		result = append(result, hello.Counter{
-			ID:      c.ID,
-			Version: c.Version,
-			Value:   c.Value,
+			ID:          c.ID,
+			Kind:        c.Kind,
+			Version:     c.Version,
+			Value:       c.Value,
+			Requests:    requests,
+			ExpiredAt:   c.ExpiredAt.Time,
+			WindowStart: c.WindowStart.Time,
+			PrevValue:   c.PrevValue,
 		})
 	}
-
 	return result, nil
 }
 
+func hashRangesCondition(ranges []core.HashRange) (string, []interface{}) {
+	args := make([]interface{}, 0, 2*len(ranges))
+	conditions := make([]string, 0, len(ranges))
+	for _, hashRange := range ranges {
+		conditions = append(conditions, "(hash BETWEEN ? AND ?)")
+		args = append(args, hashRange.Begin)
+		args = append(args, hashRange.End)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// GetCountersByHashRanges ...
+func (r *Repo) GetCountersByHashRanges(ctx context.Context, ranges []core.HashRange, limit int,
+) ([]hello.Counter, error) {
+	if len(ranges) == 0 || limit <= 0 {
+		return nil, nil
+	}
+
+	condition, args := hashRangesCondition(ranges)
+	args = append(args, limit)
+
+	query := `SELECT ` + selectCounterColumns + ` FROM counter WHERE ` + condition + ` LIMIT ?`
+
+	var counters []selectCounter
+	err := r.db.SelectContext(ctx, &counters, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return toCounters(counters)
+}
+
+// GetCounters ...
+func (r *Repo) GetCounters(ctx context.Context, ids []hello.CounterID) ([]hello.Counter, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(`SELECT `+selectCounterColumns+` FROM counter WHERE id IN (?)`, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var counters []selectCounter
+	err = r.db.SelectContext(ctx, &counters, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return toCounters(counters)
+}
+
+// BackfillHashes sets hashes of at most limit counters stored without hash,
+// returns the number of updated counters, zero if all were backfilled
+func (r *Repo) BackfillHashes(ctx context.Context, hashFn func(id hello.CounterID) core.Hash, limit int,
+) (int, error) {
+	var ids []hello.CounterID
+	err := r.db.SelectContext(ctx, &ids, `SELECT id FROM counter WHERE hash IS NULL LIMIT ?`, limit)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	args := make([]interface{}, 0, 3*len(ids))
+	var builder strings.Builder
+	for _, id := range ids {
+		builder.WriteString(" WHEN ? THEN ?")
+		args = append(args, id, hashFn(id))
+	}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	query := `UPDATE counter SET hash = CASE id` + builder.String() + ` END
+WHERE id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)`
+
+	_, err = r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
 // Transact ...
 func (r *Repo) Transact(ctx context.Context,
 	fn func(ctx context.Context, tx hello.TxRepository) error,
@@ -81,25 +219,46 @@ func (r *txRepo) UpsertCounters(ctx context.Context, counters []hello.CounterUps
 		return nil
 	}
 
-	args := make([]interface{}, 0, 3*len(counters))
+	args := make([]interface{}, 0, 9*len(counters))
 
 	var builder strings.Builder
-	_, _ = builder.WriteString("(?, ?, ?)")
+	_, _ = builder.WriteString("(?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(6))")
 	for range counters[1:] {
-		builder.WriteString(",(?, ?, ?)")
+		builder.WriteString(",(?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(6))")
 	}
 
 	for _, c := range counters {
+		requests, err := encodeAppliedRequests(c.Requests)
+		if err != nil {
+			return err
+		}
+
 		args = append(args, c.ID)
+		args = append(args, c.Hash)
+		args = append(args, c.Kind)
 		args = append(args, c.NewVersion)
 		args = append(args, c.Value)
+		args = append(args, requests)
+		args = append(args, toNullTime(c.ExpiredAt))
+		args = append(args, toNullTime(c.WindowStart))
+		args = append(args, c.PrevValue)
 	}
 
 	query := `
-INSERT INTO counter (id, version, value)
+INSERT INTO counter (
+    id, hash, kind, version, value, requests,
+    expired_at, window_start, prev_value, updated_at
+)
 VALUE %s AS new
 ON DUPLICATE KEY UPDATE
+    updated_at = new.updated_at,
+    hash = new.hash,
+    kind = new.kind,
     value = new.value,
+    requests = new.requests,
+    expired_at = new.expired_at,
+    window_start = new.window_start,
+    prev_value = new.prev_value,
     version = IF(counter.version = new.version - 1, new.version, NULL)`
 	query = fmt.Sprintf(query, builder.String())
 
@@ -115,3 +274,53 @@ ON DUPLICATE KEY UPDATE
 	}
 	return nil
 }
+
+func (r *txRepo) DeleteCounters(ctx context.Context, counters []hello.CounterDelete) error {
+	args := make([]interface{}, 0, 2*len(counters))
+	conditions := make([]string, 0, len(counters))
+	for _, c := range counters {
+		if c.Version == 0 {
+			continue
+		}
+
+		conditions = append(conditions, "(id = ? AND version = ?)")
+		args = append(args, c.ID)
+		args = append(args, c.Version)
+	}
+
+	if len(conditions) == 0 {
+		return nil
+	}
+
+	query := `DELETE FROM counter WHERE ` + strings.Join(conditions, " OR ")
+
+	result, err := r.tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != int64(len(conditions)) {
+		return hello.ErrCommandAborted
+	}
+	return nil
+}
+
+func (r *txRepo) DeleteExpiredCounters(ctx context.Context, ranges []core.HashRange, now time.Time,
+	limit int,
+) error {
+	if len(ranges) == 0 || limit <= 0 {
+		return nil
+	}
+
+	condition, args := hashRangesCondition(ranges)
+	args = append(args, now, limit)
+
+	// uses the index of (hash, expired_at)
+	query := `DELETE FROM counter WHERE ` + condition + ` AND expired_at <= ? LIMIT ?`
+	_, err := r.tx.ExecContext(ctx, query, args...)
+	return err
+}
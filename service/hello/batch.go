@@ -0,0 +1,57 @@
+package hello
+
+import (
+	"context"
+	"sharding/domain/errors"
+	domain "sharding/domain/hello"
+	rpc "sharding/rpc/hello/v1"
+	"sync"
+)
+
+// maxBatchIncreaseSize bounds goroutines started by a BatchIncrease request,
+// greater than the max batch size of clients
+const maxBatchIncreaseSize = 1000
+
+func toBatchIncreaseResult(res *rpc.IncreaseResponse, err error) *rpc.BatchIncreaseResult {
+	if err != nil {
+		st := errors.Status(err)
+		return &rpc.BatchIncreaseResult{
+			Code:    uint32(st.Code()),
+			Message: st.Message(),
+		}
+	}
+	return &rpc.BatchIncreaseResult{
+		Value: res.Value,
+	}
+}
+
+// batchIncrease calls increase for requests concurrently, for being processed in the same batch,
+// returns ErrInvalidArgument if there are more than maxBatchIncreaseSize requests
+func batchIncrease(ctx context.Context, req *rpc.BatchIncreaseRequest,
+	increase func(ctx context.Context, req *rpc.IncreaseRequest) (*rpc.IncreaseResponse, error),
+) (*rpc.BatchIncreaseResponse, error) {
+	if len(req.Requests) > maxBatchIncreaseSize {
+		return nil, domain.ErrInvalidArgument
+	}
+
+	results := make([]*rpc.BatchIncreaseResult, len(req.Requests))
+
+	var wg sync.WaitGroup
+	wg.Add(len(req.Requests))
+
+	for i, r := range req.Requests {
+		index := i
+		incReq := r
+		go func() {
+			defer wg.Done()
+
+			res, err := increase(ctx, incReq)
+			results[index] = toBatchIncreaseResult(res, err)
+		}()
+	}
+
+	wg.Wait()
+	return &rpc.BatchIncreaseResponse{
+		Results: results,
+	}, nil
+}
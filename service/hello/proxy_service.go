@@ -2,57 +2,71 @@ package hello
 
 import (
 	"context"
-	"fmt"
+	"sharding/client"
 	"sharding/core"
-	"sharding/domain/hello"
 	rpc "sharding/rpc/hello/v1"
-	"sync"
 	"time"
 
 	"go.uber.org/zap"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/backoff"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 // ProxyService for proxy gRPC
 type ProxyService struct {
 	rpc.UnimplementedHelloServer
-	logger *zap.Logger
-
-	mut     sync.RWMutex
-	nodes   []core.NodeInfo
-	connMap map[string]*grpc.ClientConn
+	logger    *zap.Logger
+	client    *client.Client
+	ring      *ring
+	closeChan <-chan struct{}
 }
 
 var _ rpc.HelloServer = &ProxyService{}
 
 // NewProxyService create a new ProxyService
-func NewProxyService() *ProxyService {
+func NewProxyService(closeChan <-chan struct{}, logger *zap.Logger, connOpts client.ConnOptions,
+) *ProxyService {
+	c := client.New(connOpts)
+	c.SetLogger(logger)
+
 	return &ProxyService{
-		connMap: make(map[string]*grpc.ClientConn),
+		logger:    logger,
+		client:    c,
+		ring:      newRing(),
+		closeChan: closeChan,
 	}
 }
 
 // Increase do hello
 func (s *ProxyService) Increase(ctx context.Context, req *rpc.IncreaseRequest,
 ) (*rpc.IncreaseResponse, error) {
-	hash := core.HashUint32(req.Counter)
-	var res *rpc.IncreaseResponse
-
-	err := s.call(ctx, hash, func(ctx context.Context, conn *grpc.ClientConn) error {
-		client := rpc.NewHelloClient(conn)
-
-		var err error
-		res, err = client.Increase(ctx, req)
-		return err
-	})
-	if err != nil {
-		return nil, err
-	}
+	return s.client.Increase(ctx, req)
+}
+
+// BatchIncrease increases counters of many requests, results are in the same order
+func (s *ProxyService) BatchIncrease(ctx context.Context, req *rpc.BatchIncreaseRequest,
+) (*rpc.BatchIncreaseResponse, error) {
+	return batchIncrease(ctx, req, s.client.Increase)
+}
+
+// StreamIncrease increases counters of a stream of requests, replies when each one completed
+func (s *ProxyService) StreamIncrease(stream rpc.Hello_StreamIncreaseServer) error {
+	return streamIncrease(stream, s.closeChan, s.client.Increase)
+}
+
+// CheckAndIncrease increases a window counter if below the limit
+func (s *ProxyService) CheckAndIncrease(ctx context.Context, req *rpc.CheckAndIncreaseRequest,
+) (*rpc.CheckAndIncreaseResponse, error) {
+	return s.client.CheckAndIncrease(ctx, req)
+}
+
+// Get reads a counter from its owner, stale reads may be hedged
+func (s *ProxyService) Get(ctx context.Context, req *rpc.GetRequest) (*rpc.GetResponse, error) {
+	return s.client.Get(ctx, req)
+}
 
-	return res, nil
+// Delete deletes a counter
+func (s *ProxyService) Delete(ctx context.Context, req *rpc.DeleteRequest,
+) (*rpc.DeleteResponse, error) {
+	return s.client.Delete(ctx, req)
 }
 
 // Ping for core's watch
@@ -60,128 +74,38 @@ func (s *ProxyService) Ping(req *rpc.PingRequest, server rpc.Hello_PingServer) e
 	return nil
 }
 
-// Watch for node infos
-func (s *ProxyService) Watch(newNodes []core.NodeInfo) {
-	fmt.Println(newNodes)
+// EnableBatching coalesces concurrent Increase requests per node
+func (s *ProxyService) EnableBatching(window time.Duration, maxSize int) {
+	s.client.EnableBatching(window, maxSize)
+}
 
-	copyConnMap := make(map[string]*grpc.ClientConn)
-	s.mut.RLock()
-	for key, val := range s.connMap {
-		copyConnMap[key] = val
-	}
-	oldNodes := s.nodes
-	s.mut.RUnlock()
+// SetRetryPolicy configures retrying calls to nodes
+func (s *ProxyService) SetRetryPolicy(policy client.RetryPolicy) {
+	s.client.SetRetryPolicy(policy)
+}
 
-	diff := core.ComputeAddressesDifference(oldNodes, newNodes)
+// EnableHedging hedges stale reads to the next node of the ring
+func (s *ProxyService) EnableHedging(policy client.HedgePolicy) {
+	s.client.EnableHedging(policy)
+}
 
-	for _, deleted := range diff.Deleted {
-		err := copyConnMap[deleted].Close()
-		if err != nil {
-			fmt.Println(err)
-		}
+// EnableCircuitBreaker fails fast when calling unhealthy nodes
+func (s *ProxyService) EnableCircuitBreaker(policy client.BreakerPolicy) {
+	s.client.EnableCircuitBreaker(policy)
+}
 
-		delete(copyConnMap, deleted)
-	}
+// EnableStreaming multiplexes Increase requests per node over one stream
+func (s *ProxyService) EnableStreaming() {
+	s.client.EnableStreaming()
+}
 
-	for _, addr := range diff.Inserted {
-		connectParams := grpc.ConnectParams{
-			Backoff: backoff.Config{
-				BaseDelay:  5 * time.Second,
-				Multiplier: 1.0,
-				Jitter:     0.3,
-				MaxDelay:   10 * time.Second,
-			},
-		}
-
-		conn, err := grpc.Dial(addr,
-			grpc.WithConnectParams(connectParams),
-			grpc.WithInsecure(),
-		)
-		if err != nil {
-			s.logger.Error("Dial", zap.Error(err))
-			continue
-		}
-
-		copyConnMap[addr] = conn
-	}
+// Watch for node infos
+func (s *ProxyService) Watch(wr core.WatchResponse) {
+	s.ring.update(wr)
+	s.client.Watch(wr.Nodes)
+}
 
-	s.mut.Lock()
-	s.nodes = newNodes
-	s.connMap = copyConnMap
-	s.mut.Unlock()
-}
-
-func (s *ProxyService) call(ctx context.Context, hash core.Hash,
-	fn func(ctx context.Context, conn *grpc.ClientConn) error,
-) error {
-	retryCount := 0
-	for {
-		s.mut.RLock()
-		serviceNodes := s.nodes
-		connMap := s.connMap
-		s.mut.RUnlock()
-
-		nullAddress := core.GetNodeAddress(serviceNodes, hash)
-		if !nullAddress.Valid {
-			retryCount++
-			if retryCount > 3 {
-				return hello.ErrServiceUnavailable
-			}
-
-			fmt.Println("Null Address:", retryCount)
-
-			select {
-			case <-ctx.Done():
-				return hello.ErrClientAborted
-			case <-time.After(time.Duration(retryCount) * 5 * time.Second):
-				continue
-			}
-		}
-
-		addr := nullAddress.Address
-		conn, ok := connMap[addr]
-		if !ok {
-			retryCount++
-			if retryCount > 3 {
-				return hello.ErrServiceUnavailable
-			}
-
-			fmt.Println("No conn")
-
-			select {
-			case <-ctx.Done():
-				return hello.ErrClientAborted
-			case <-time.After(time.Duration(retryCount) * 5 * time.Second):
-				continue
-			}
-		}
-
-		err := fn(ctx, conn)
-		if err != nil {
-			st, ok := status.FromError(err)
-			if !ok {
-				return err
-			}
-
-			if st.Code() == codes.Aborted || st.Code() == codes.Unavailable {
-				retryCount++
-				if retryCount > 3 {
-					return hello.ErrServiceUnavailable
-				}
-
-				fmt.Println("Aborted:", retryCount)
-
-				select {
-				case <-ctx.Done():
-					return hello.ErrClientAborted
-				case <-time.After(time.Duration(retryCount) * 5 * time.Second):
-					continue
-				}
-			}
-
-			return err
-		}
-
-		return nil
-	}
+// WatchRing streams the view of the ring of the proxy
+func (s *ProxyService) WatchRing(req *rpc.WatchRingRequest, server rpc.Hello_WatchRingServer) error {
+	return streamRing(s.ring, server, s.closeChan)
 }
@@ -0,0 +1,77 @@
+package hello
+
+import (
+	"sharding/core"
+	rpc "sharding/rpc/hello/v1"
+	"sync"
+)
+
+// ring keeps the latest view of the ring for WatchRing streams
+type ring struct {
+	mut    sync.Mutex
+	latest core.WatchResponse
+	valid  bool
+	// changed is closed on the next update
+	changed chan struct{}
+}
+
+func newRing() *ring {
+	return &ring{
+		changed: make(chan struct{}),
+	}
+}
+
+func (r *ring) update(wr core.WatchResponse) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.latest = wr
+	r.valid = true
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// get returns the latest view, false if not yet received, and the channel closed on the next update
+func (r *ring) get() (core.WatchResponse, bool, <-chan struct{}) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	return r.latest, r.valid, r.changed
+}
+
+func toWatchRingResponse(wr core.WatchResponse) *rpc.WatchRingResponse {
+	nodes := make([]*rpc.NodeInfo, 0, len(wr.Nodes))
+	for _, n := range wr.Nodes {
+		nodes = append(nodes, &rpc.NodeInfo{
+			NodeId:  uint32(n.NodeID),
+			Hash:    uint32(n.Hash),
+			Address: n.Address,
+		})
+	}
+	return &rpc.WatchRingResponse{
+		Epoch: wr.Epoch,
+		Nodes: nodes,
+	}
+}
+
+// streamRing sends the current view then every change until the stream or closeChan is done
+func streamRing(r *ring, server rpc.Hello_WatchRingServer, closeChan <-chan struct{}) error {
+	ctx := server.Context()
+	for {
+		wr, valid, changed := r.get()
+		if valid {
+			err := server.Send(toWatchRingResponse(wr))
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		case <-closeChan:
+			return nil
+		}
+	}
+}
@@ -2,15 +2,36 @@ package hello
 
 import (
 	"context"
+	"sharding/client"
+	"sharding/core"
 	domain "sharding/domain/hello"
 	rpc "sharding/rpc/hello/v1"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/metadata"
 )
 
+// forwardHopsKey is the metadata key counting forwards of a request between nodes
+const forwardHopsKey = "x-forward-hops"
+
+// router routes forwarded requests, implemented by client.Router
+type router interface {
+	Watch(nodes []core.NodeInfo)
+	GetRoute(hash core.Hash) (client.Route, bool)
+}
+
 // Service for gRPC
 type Service struct {
 	rpc.UnimplementedHelloServer
 	port      domain.Port
 	closeChan <-chan struct{}
+	ring      *ring
+
+	// router is nil if forwarding is disabled
+	router     router
+	selfNodeID core.NodeID
+	maxHops    int
 }
 
 // NewService create a new Service
@@ -18,18 +39,192 @@ func NewService(port domain.Port, closeChan <-chan struct{}) *Service {
 	return &Service{
 		port:      port,
 		closeChan: closeChan,
+		ring:      newRing(),
+	}
+}
+
+// EnableForwarding forwards requests of counters not owned by the node to their owners,
+// a request is forwarded at most maxHops times when nodes have different views of the ring
+func (s *Service) EnableForwarding(selfNodeID core.NodeID, maxHops int, connOpts client.ConnOptions) {
+	s.router = client.NewRouter(connOpts)
+	s.selfNodeID = selfNodeID
+	s.maxHops = maxHops
+}
+
+// Watch updates the view of the ring for forwarding and WatchRing
+func (s *Service) Watch(wr core.WatchResponse) {
+	s.ring.update(wr)
+
+	if s.router == nil {
+		return
+	}
+	s.router.Watch(wr.Nodes)
+}
+
+func forwardHops(ctx context.Context) int {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0
 	}
+	values := md.Get(forwardHopsKey)
+	if len(values) == 0 {
+		return 0
+	}
+	hops, err := strconv.Atoi(values[0])
+	if err != nil {
+		return 0
+	}
+	return hops
+}
+
+// forward calls the owner of the hash, returns ErrNotOwner if the request can not be forwarded
+func (s *Service) forward(ctx context.Context, hash core.Hash,
+	fn func(ctx context.Context, client rpc.HelloClient) error,
+) error {
+	if s.router == nil {
+		return domain.ErrNotOwner
+	}
+
+	hops := forwardHops(ctx)
+	if hops >= s.maxHops {
+		return domain.ErrNotOwner
+	}
+
+	rt, ok := s.router.GetRoute(hash)
+	if !ok {
+		return domain.ErrNotOwner
+	}
+	defer rt.Release()
+
+	if rt.NodeID == s.selfNodeID {
+		return domain.ErrNotOwner
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardHopsKey, strconv.Itoa(hops+1))
+	return fn(ctx, rpc.NewHelloClient(rt.Conn))
 }
 
 // Increase do hello
 func (s *Service) Increase(ctx context.Context, req *rpc.IncreaseRequest,
 ) (*rpc.IncreaseResponse, error) {
-	err := s.port.Increase(ctx, domain.CounterID(req.Counter))
+	value, err := s.port.Increase(ctx, domain.IncreaseInput{
+		CounterID: domain.CounterID(req.Counter),
+		RequestID: domain.RequestID(req.RequestId),
+		TTL:       time.Duration(req.TtlSeconds) * time.Second,
+	})
+	if err == domain.ErrNotOwner {
+		var res *rpc.IncreaseResponse
+		err := s.forward(ctx, core.HashUint32(req.Counter), func(ctx context.Context, client rpc.HelloClient) error {
+			var err error
+			res, err = client.Increase(ctx, req)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &rpc.IncreaseResponse{}, nil
+	return &rpc.IncreaseResponse{
+		Value: value,
+	}, nil
+}
+
+// BatchIncrease increases counters of many requests, results are in the same order
+func (s *Service) BatchIncrease(ctx context.Context, req *rpc.BatchIncreaseRequest,
+) (*rpc.BatchIncreaseResponse, error) {
+	return batchIncrease(ctx, req, s.Increase)
+}
+
+// StreamIncrease increases counters of a stream of requests, replies when each one completed
+func (s *Service) StreamIncrease(stream rpc.Hello_StreamIncreaseServer) error {
+	return streamIncrease(stream, s.closeChan, s.Increase)
+}
+
+// CheckAndIncrease increases a window counter if below the limit
+func (s *Service) CheckAndIncrease(ctx context.Context, req *rpc.CheckAndIncreaseRequest,
+) (*rpc.CheckAndIncreaseResponse, error) {
+	output, err := s.port.CheckAndIncrease(ctx, domain.CheckAndIncreaseInput{
+		CounterID: domain.CounterID(req.Counter),
+		RequestID: domain.RequestID(req.RequestId),
+		Limit:     req.Limit,
+		Window:    time.Duration(req.WindowMs) * time.Millisecond,
+		Sliding:   req.Sliding,
+	})
+	if err == domain.ErrNotOwner {
+		var res *rpc.CheckAndIncreaseResponse
+		err := s.forward(ctx, core.HashUint32(req.Counter), func(ctx context.Context, client rpc.HelloClient) error {
+			var err error
+			res, err = client.CheckAndIncrease(ctx, req)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpc.CheckAndIncreaseResponse{
+		Allowed: output.Allowed,
+		Count:   output.Count,
+	}, nil
+}
+
+// Get reads a counter, stale reads are served locally instead of being forwarded
+func (s *Service) Get(ctx context.Context, req *rpc.GetRequest) (*rpc.GetResponse, error) {
+	output, err := s.port.Get(ctx, domain.GetInput{
+		CounterID:  domain.CounterID(req.Counter),
+		AllowStale: req.AllowStale,
+	})
+	if err == domain.ErrNotOwner {
+		var res *rpc.GetResponse
+		err := s.forward(ctx, core.HashUint32(req.Counter), func(ctx context.Context, client rpc.HelloClient) error {
+			var err error
+			res, err = client.Get(ctx, req)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpc.GetResponse{
+		Value: output.Value,
+		Stale: output.Stale,
+	}, nil
+}
+
+// Delete deletes a counter
+func (s *Service) Delete(ctx context.Context, req *rpc.DeleteRequest,
+) (*rpc.DeleteResponse, error) {
+	err := s.port.Delete(ctx, domain.CounterID(req.Counter))
+	if err == domain.ErrNotOwner {
+		var res *rpc.DeleteResponse
+		err := s.forward(ctx, core.HashUint32(req.Counter), func(ctx context.Context, client rpc.HelloClient) error {
+			var err error
+			res, err = client.Delete(ctx, req)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpc.DeleteResponse{}, nil
 }
 
 // Ping for core's watch
@@ -47,3 +242,8 @@ func (s *Service) Ping(req *rpc.PingRequest, server rpc.Hello_PingServer) error
 		return nil
 	}
 }
+
+// WatchRing streams the view of the ring of the node, ends when the node is draining
+func (s *Service) WatchRing(req *rpc.WatchRingRequest, server rpc.Hello_WatchRingServer) error {
+	return streamRing(s.ring, server, s.closeChan)
+}
@@ -0,0 +1,161 @@
+package hello
+
+import (
+	"context"
+	"sharding/client"
+	"sharding/core"
+	domain "sharding/domain/hello"
+	rpc "sharding/rpc/hello/v1"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+type fakeRouter struct {
+	routes map[core.Hash]client.Route
+}
+
+func (r *fakeRouter) Watch(nodes []core.NodeInfo) {
+}
+
+func (r *fakeRouter) GetRoute(hash core.Hash) (client.Route, bool) {
+	rt, ok := r.routes[hash]
+	return rt, ok
+}
+
+func TestForwardHops(t *testing.T) {
+	table := []struct {
+		name string
+		md   metadata.MD
+		hops int
+	}{
+		{
+			name: "no-metadata",
+			hops: 0,
+		},
+		{
+			name: "no-hops",
+			md:   metadata.Pairs("other", "1"),
+			hops: 0,
+		},
+		{
+			name: "hops",
+			md:   metadata.Pairs(forwardHopsKey, "2"),
+			hops: 2,
+		},
+		{
+			name: "invalid",
+			md:   metadata.Pairs(forwardHopsKey, "abc"),
+			hops: 0,
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			ctx := context.Background()
+			if e.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, e.md)
+			}
+			assert.Equal(t, e.hops, forwardHops(ctx))
+		})
+	}
+}
+
+func TestService_Forward(t *testing.T) {
+	routes := map[core.Hash]client.Route{
+		10: {NodeID: 2, Address: "localhost:6000"},
+		11: {NodeID: 1, Address: "localhost:5000"},
+	}
+
+	table := []struct {
+		name   string
+		router router
+		hash   core.Hash
+		md     metadata.MD
+
+		err error
+		// hops of the forwarded request, zero if not forwarded
+		forwardedHops []string
+	}{
+		{
+			name: "disabled",
+			hash: 10,
+			err:  domain.ErrNotOwner,
+		},
+		{
+			name:          "forwarded",
+			router:        &fakeRouter{routes: routes},
+			hash:          10,
+			forwardedHops: []string{"1"},
+		},
+		{
+			name:          "forwarded-again",
+			router:        &fakeRouter{routes: routes},
+			hash:          10,
+			md:            metadata.Pairs(forwardHopsKey, "1"),
+			forwardedHops: []string{"2"},
+		},
+		{
+			name:   "max-hops",
+			router: &fakeRouter{routes: routes},
+			hash:   10,
+			md:     metadata.Pairs(forwardHopsKey, "2"),
+			err:    domain.ErrNotOwner,
+		},
+		{
+			name:   "no-route",
+			router: &fakeRouter{routes: routes},
+			hash:   12,
+			err:    domain.ErrNotOwner,
+		},
+		{
+			name:   "self",
+			router: &fakeRouter{routes: routes},
+			hash:   11,
+			err:    domain.ErrNotOwner,
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			s := NewService(nil, nil)
+			s.router = e.router
+			s.selfNodeID = 1
+			s.maxHops = 2
+
+			ctx := context.Background()
+			if e.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, e.md)
+			}
+
+			var forwardedHops []string
+			err := s.forward(ctx, e.hash, func(ctx context.Context, client rpc.HelloClient) error {
+				md, _ := metadata.FromOutgoingContext(ctx)
+				forwardedHops = md.Get(forwardHopsKey)
+				return nil
+			})
+			assert.Equal(t, e.err, err)
+			assert.Equal(t, e.forwardedHops, forwardedHops)
+		})
+	}
+}
+
+func TestBatchIncrease_MaxSize(t *testing.T) {
+	increase := func(ctx context.Context, req *rpc.IncreaseRequest) (*rpc.IncreaseResponse, error) {
+		return &rpc.IncreaseResponse{Value: req.Counter}, nil
+	}
+
+	req := &rpc.BatchIncreaseRequest{}
+	for i := 0; i < maxBatchIncreaseSize; i++ {
+		req.Requests = append(req.Requests, &rpc.IncreaseRequest{Counter: uint32(i)})
+	}
+	res, err := batchIncrease(context.Background(), req, increase)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, maxBatchIncreaseSize, len(res.Results))
+	assert.Equal(t, uint32(10), res.Results[10].Value)
+
+	req.Requests = append(req.Requests, &rpc.IncreaseRequest{Counter: 10})
+	_, err = batchIncrease(context.Background(), req, increase)
+	assert.Equal(t, domain.ErrInvalidArgument, err)
+}
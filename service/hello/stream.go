@@ -0,0 +1,109 @@
+package hello
+
+import (
+	"context"
+	"io"
+	"sharding/domain/errors"
+	domain "sharding/domain/hello"
+	rpc "sharding/rpc/hello/v1"
+	"sync"
+	"time"
+)
+
+// maxStreamInFlight bounds requests of a stream being processed concurrently,
+// receiving is paused when reached
+const maxStreamInFlight = 1024
+
+func toStreamIncreaseResponse(correlationID uint64, res *rpc.IncreaseResponse, err error,
+) *rpc.StreamIncreaseResponse {
+	if err != nil {
+		st := errors.Status(err)
+		return &rpc.StreamIncreaseResponse{
+			CorrelationId: correlationID,
+			Code:          uint32(st.Code()),
+			Message:       st.Message(),
+		}
+	}
+	return &rpc.StreamIncreaseResponse{
+		CorrelationId: correlationID,
+		Value:         res.Value,
+	}
+}
+
+func streamRequestContext(ctx context.Context, timeoutMs uint32) (context.Context, context.CancelFunc) {
+	if timeoutMs == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+}
+
+// streamIncrease calls increase for requests of the stream concurrently until the client
+// closes the stream or closeChan is done, in-flight requests are replied before returning
+func streamIncrease(stream rpc.Hello_StreamIncreaseServer, closeChan <-chan struct{},
+	increase func(ctx context.Context, req *rpc.IncreaseRequest) (*rpc.IncreaseResponse, error),
+) error {
+	ctx := stream.Context()
+
+	reqChan := make(chan *rpc.StreamIncreaseRequest)
+	recvErrChan := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErrChan <- err
+				return
+			}
+
+			select {
+			case reqChan <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var sendMut sync.Mutex
+	send := func(res *rpc.StreamIncreaseResponse) {
+		sendMut.Lock()
+		defer sendMut.Unlock()
+
+		// the stream is broken if failed, the client retries its requests
+		_ = stream.Send(res)
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, maxStreamInFlight)
+	for {
+		select {
+		case req := <-reqChan:
+			if req.Request == nil {
+				send(toStreamIncreaseResponse(req.CorrelationId, nil, domain.ErrInvalidArgument))
+				continue
+			}
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				reqCtx, cancel := streamRequestContext(ctx, req.TimeoutMs)
+				defer cancel()
+
+				res, err := increase(reqCtx, req.Request)
+				send(toStreamIncreaseResponse(req.CorrelationId, res, err))
+			}()
+
+		case err := <-recvErrChan:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+
+		case <-closeChan:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package hello
+
+import (
+	"context"
+	rpc "sharding/rpc/hello/v1"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+type fakeStreamIncreaseServer struct {
+	grpc.ServerStream
+	reqChan chan *rpc.StreamIncreaseRequest
+
+	mut       sync.Mutex
+	responses []*rpc.StreamIncreaseResponse
+}
+
+func (s *fakeStreamIncreaseServer) Context() context.Context {
+	return context.Background()
+}
+
+func (s *fakeStreamIncreaseServer) Recv() (*rpc.StreamIncreaseRequest, error) {
+	return <-s.reqChan, nil
+}
+
+func (s *fakeStreamIncreaseServer) Send(res *rpc.StreamIncreaseResponse) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.responses = append(s.responses, res)
+	return nil
+}
+
+func TestStreamIncrease_DrainInFlight(t *testing.T) {
+	stream := &fakeStreamIncreaseServer{reqChan: make(chan *rpc.StreamIncreaseRequest)}
+	closeChan := make(chan struct{})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	increase := func(ctx context.Context, req *rpc.IncreaseRequest) (*rpc.IncreaseResponse, error) {
+		close(started)
+		<-release
+		return &rpc.IncreaseResponse{Value: req.Counter}, nil
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- streamIncrease(stream, closeChan, increase)
+	}()
+
+	stream.reqChan <- &rpc.StreamIncreaseRequest{
+		CorrelationId: 7,
+		Request:       &rpc.IncreaseRequest{Counter: 10},
+	}
+	<-started
+	close(closeChan)
+
+	// waits for the in-flight request
+	select {
+	case <-errChan:
+		t.Fatal("returned before the in-flight request was replied")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, nil, <-errChan)
+	assert.Equal(t, []*rpc.StreamIncreaseResponse{
+		{CorrelationId: 7, Value: 10},
+	}, stream.responses)
+}
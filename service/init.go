@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sharding/client"
 	"sharding/config"
 	"sharding/core"
 	"sharding/core/impl"
@@ -13,19 +14,25 @@ import (
 	hello_rpc "sharding/rpc/hello/v1"
 	hello_service "sharding/service/hello"
 	"strconv"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // Root represents the whole app
 type Root struct {
-	nodeConfig config.NodeConfig
-	core       core.Service
-	port       hello.Port
-	closeChan  chan<- struct{}
+	nodeConfig     config.NodeConfig
+	shutdownConfig config.ShutdownConfig
+	core           core.Service
+	port           hello.Port
+	service        *hello_service.Service
+	health         *health.Server
+	closeChan      chan<- struct{}
 }
 
 func getSelfNodeID() core.NodeID {
@@ -66,18 +73,41 @@ func InitRoot(server *grpc.Server, logger *zap.Logger) *Root {
 	core := impl.NewEtcdCoreService()
 	repo := hello_repo.NewRepo(db)
 
-	port := hello_logic.NewPort(nodeConfig, repo)
+	port := hello_logic.NewPort(nodeConfig, cfg.Processor, repo)
 
 	closeChan := make(chan struct{})
 
 	s := hello_service.NewService(port, closeChan)
+	if cfg.Forward.Enabled {
+		s.EnableForwarding(selfNodeID, cfg.Forward.MaxHops, toConnOptions(cfg.Conn, logger))
+	}
 	hello_rpc.RegisterHelloServer(server, s)
 
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+
 	return &Root{
-		nodeConfig: nodeConfig,
-		core:       core,
-		port:       port,
-		closeChan:  closeChan,
+		nodeConfig:     nodeConfig,
+		shutdownConfig: cfg.Shutdown,
+		core:           core,
+		port:           port,
+		service:        s,
+		health:         healthServer,
+		closeChan:      closeChan,
+	}
+}
+
+func toConnOptions(cfg config.ConnConfig, logger *zap.Logger) client.ConnOptions {
+	return client.ConnOptions{
+		BaseDelay:           cfg.BaseDelay,
+		MaxDelay:            cfg.MaxDelay,
+		MinConnectTimeout:   cfg.MinConnectTimeout,
+		KeepaliveTime:       cfg.KeepaliveTime,
+		KeepaliveTimeout:    cfg.KeepaliveTimeout,
+		HealthCheckInterval: cfg.HealthCheckInterval,
+		HealthCheckTimeout:  cfg.HealthCheckTimeout,
+		CloseTimeout:        cfg.CloseTimeout,
+		Logger:              logger,
 	}
 }
 
@@ -94,8 +124,13 @@ func errIsNotContext(err error) bool {
 	return false
 }
 
+// runLoop returns true if it needs to be restarted
 func (r *Root) runLoop(ctx context.Context) bool {
-	ctx, cancel := context.WithCancel(ctx)
+	// the core and the processor are stopped separately when draining
+	coreCtx, cancelCore := context.WithCancel(context.Background())
+	processCtx, cancelProcess := context.WithCancel(context.Background())
+	defer cancelCore()
+	defer cancelProcess()
 
 	node := r.nodeConfig
 	info := core.NodeInfo{
@@ -104,44 +139,115 @@ func (r *Root) runLoop(ctx context.Context) bool {
 		Address: node.ToAddress(),
 	}
 
+	coreWatchChan := make(chan core.WatchResponse, 1)
 	watchChan := make(chan core.WatchResponse, 1)
-	errChan := make(chan error, 2)
+	coreErrChan := make(chan error, 1)
+	processErrChan := make(chan error, 1)
 
 	go func() {
-		err := r.core.KeepAliveAndWatch(ctx, info, watchChan)
-		errChan <- err
+		err := r.core.KeepAliveAndWatch(coreCtx, info, coreWatchChan)
+		coreErrChan <- err
 	}()
 
+	go r.watchNodes(processCtx, coreWatchChan, watchChan)
+
 	go func() {
-		err := r.port.Process(ctx, watchChan)
-		errChan <- err
+		err := r.port.Process(processCtx, watchChan)
+		processErrChan <- err
 	}()
 
-	err := <-errChan
-	if errIsNotContext(err) {
+	select {
+	case err := <-coreErrChan:
 		fmt.Println(err)
-		cancel()
-		<-errChan
+		cancelProcess()
+		<-processErrChan
 		return true
-	}
 
-	err = <-errChan
-	if errIsNotContext(err) {
+	case err := <-processErrChan:
 		fmt.Println(err)
-		cancel()
+		cancelCore()
+		<-coreErrChan
 		return true
+
+	case <-ctx.Done():
 	}
 
-	cancel()
+	r.drain(cancelCore, coreErrChan, cancelProcess, processErrChan)
 	return false
 }
 
-// Run other processes
-func (r *Root) Run(ctx context.Context) {
-	for r.runLoop(ctx) {
+// watchNodes passes changes of nodes to the service for forwarding, then to the processor
+func (r *Root) watchNodes(ctx context.Context, coreWatchChan <-chan core.WatchResponse,
+	watchChan chan<- core.WatchResponse,
+) {
+	for {
+		select {
+		case wr := <-coreWatchChan:
+			r.service.Watch(wr)
+
+			select {
+			case watchChan <- wr:
+			case <-ctx.Done():
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
 	}
+}
 
+// drain stops the node without losing queued commands:
+// deregisters the node, rejects new commands with ErrNotOwner for forwarding them to the new owners,
+// processes and persists queued commands before the new owners load them,
+// waits for proxies to observe the removal, then stops serving health checks
+func (r *Root) drain(
+	cancelCore func(), coreErrChan <-chan error,
+	cancelProcess func(), processErrChan <-chan error,
+) {
+	deadline := time.After(r.shutdownConfig.Timeout)
+
+	fmt.Println("Deregistering")
+	cancelCore()
 	close(r.closeChan)
+
+	select {
+	case err := <-coreErrChan:
+		if errIsNotContext(err) {
+			fmt.Println(err)
+		}
+	case <-deadline:
+		fmt.Println("Deregister timeout")
+	}
+
+	propagated := time.After(r.shutdownConfig.PropagationDelay)
+
+	fmt.Println("Draining")
+	r.port.Close()
+	cancelProcess()
+
+	select {
+	case err := <-processErrChan:
+		if errIsNotContext(err) {
+			fmt.Println(err)
+		}
+	case <-deadline:
+		fmt.Println("Drain timeout")
+	}
+
+	select {
+	case <-propagated:
+	case <-deadline:
+	}
+
+	// reported not serving only after the queued commands were replied
+	r.health.Shutdown()
+}
+
+// Run other processes until the context is done and the node is drained
+func (r *Root) Run(ctx context.Context) {
+	for r.runLoop(ctx) {
+	}
 }
 
 // GetNodeConfig ...
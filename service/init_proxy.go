@@ -3,71 +3,239 @@ package service
 import (
 	"context"
 	"fmt"
+	"os"
+	"sharding/client"
 	"sharding/config"
 	"sharding/core"
 	"sharding/core/impl"
 	hello_rpc "sharding/rpc/hello/v1"
 	"sharding/service/hello"
 	hello_service "sharding/service/hello"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
+// registerRetryDelay is the delay before registering the proxy again after failed
+const registerRetryDelay = 1 * time.Second
+
 // ProxyRoot for proxy
 type ProxyRoot struct {
-	proxyConfig config.ProxyConfig
-	core        core.Service
-	service     *hello.ProxyService
+	selfConfig     config.NodeConfig
+	shutdownConfig config.ShutdownConfig
+	core           core.Service
+	// membership is nil for the single proxy started without an id
+	membership core.Service
+	service    *hello.ProxyService
+	health     *health.Server
+	closeChan  chan<- struct{}
+}
+
+// getSelfProxyConfig returns the instance of the id argument,
+// false for the single proxy started without an id
+func getSelfProxyConfig(cfg config.Config) (config.NodeConfig, bool) {
+	if len(os.Args) <= 1 {
+		return config.NodeConfig{
+			Host: "localhost",
+			Port: cfg.Proxy.Port,
+		}, false
+	}
+	return getSelfNodeConfig(cfg.Proxies, getSelfNodeID()), true
 }
 
 // InitProxyRoot creates a Root
 func InitProxyRoot(server *grpc.Server, logger *zap.Logger) *ProxyRoot {
 	cfg := config.LoadConfig()
 
+	selfConfig, registered := getSelfProxyConfig(cfg)
+	var membership core.Service
+	if registered {
+		fmt.Println("Proxy ID:", selfConfig.ID)
+		membership = impl.NewEtcdProxyService()
+	}
+
 	// db := sqlx.MustConnect("mysql", "root:1@tcp(localhost:3306)/bench?parseTime=true")
-	coreService := impl.NewEtcdCoreService()
+	connOpts := toConnOptions(cfg.Conn, logger)
 
-	s := hello_service.NewProxyService()
+	var coreService core.Service
+	if len(cfg.Proxy.RingSeeds) > 0 {
+		coreService = client.NewRingService(cfg.Proxy.RingSeeds, connOpts)
+	} else {
+		coreService = impl.NewEtcdCoreService()
+	}
+
+	closeChan := make(chan struct{})
+	s := hello_service.NewProxyService(closeChan, logger, connOpts)
+	s.SetRetryPolicy(toRetryPolicy(cfg.Proxy.Retry))
+	if cfg.Proxy.Breaker.Enabled {
+		s.EnableCircuitBreaker(client.BreakerPolicy{
+			ConsecutiveFailures: cfg.Proxy.Breaker.ConsecutiveFailures,
+			ErrorRate:           cfg.Proxy.Breaker.ErrorRate,
+			MinRequests:         cfg.Proxy.Breaker.MinRequests,
+			Window:              cfg.Proxy.Breaker.Window,
+			OpenDuration:        cfg.Proxy.Breaker.OpenDuration,
+			HalfOpenProbes:      cfg.Proxy.Breaker.HalfOpenProbes,
+		})
+	}
+	if cfg.Proxy.Hedge.Enabled {
+		s.EnableHedging(client.HedgePolicy{
+			Percentile:   cfg.Proxy.Hedge.Percentile,
+			InitialDelay: cfg.Proxy.Hedge.InitialDelay,
+			MinDelay:     cfg.Proxy.Hedge.MinDelay,
+		})
+	}
+	if cfg.Proxy.Streaming {
+		s.EnableStreaming()
+	} else if cfg.Proxy.BatchWindow > 0 {
+		s.EnableBatching(cfg.Proxy.BatchWindow, cfg.Proxy.MaxBatchSize)
+	}
 
 	hello_rpc.RegisterHelloServer(server, s)
 
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+
 	return &ProxyRoot{
-		proxyConfig: cfg.Proxy,
-		core:        coreService,
-		service:     s,
+		selfConfig:     selfConfig,
+		shutdownConfig: cfg.Shutdown,
+		core:           coreService,
+		membership:     membership,
+		service:        s,
+		health:         healthServer,
+		closeChan:      closeChan,
+	}
+}
+
+func toRetryPolicy(cfg config.RetryConfig) client.RetryPolicy {
+	retryableCodes, err := client.ParseCodes(cfg.RetryableCodes)
+	if err != nil {
+		panic(err)
+	}
+
+	return client.RetryPolicy{
+		MaxAttempts:        cfg.MaxAttempts,
+		InitialBackoff:     cfg.InitialBackoff,
+		MaxBackoff:         cfg.MaxBackoff,
+		AttemptTimeout:     cfg.AttemptTimeout,
+		Budget:             cfg.Budget,
+		RetryableCodes:     retryableCodes,
+		ThrottleMaxTokens:  cfg.MaxTokens,
+		ThrottleTokenRatio: cfg.TokenRatio,
 	}
 }
 
-// Run ...
+// Run watches the ring and keeps the proxy registered until the context is done,
+// then drains the proxy
 func (r *ProxyRoot) Run(ctx context.Context) {
+	registerDone := make(chan struct{})
+	go func() {
+		r.register(ctx)
+		close(registerDone)
+	}()
+
+	r.watch(ctx)
+	r.drain(registerDone)
+}
+
+func (r *ProxyRoot) watch(ctx context.Context) {
 	for {
 		watchChan := make(chan core.WatchResponse, 1)
 		err := r.core.Watch(ctx, watchChan)
 		if err != nil {
 			fmt.Println(err)
+			if ctx.Err() != nil {
+				return
+			}
 			continue
 		}
 
-		for wr := range watchChan {
-			r.service.Watch(wr.Nodes)
+		for {
+			select {
+			case wr := <-watchChan:
+				r.service.Watch(wr)
+
+			case <-ctx.Done():
+				return
+			}
 		}
+	}
+}
 
+// register keeps the proxy in the membership of proxies until the context is done
+func (r *ProxyRoot) register(ctx context.Context) {
+	if r.membership == nil {
 		return
 	}
+
+	info := core.NodeInfo{
+		NodeID:  r.selfConfig.ID,
+		Address: r.selfConfig.ToAddress(),
+	}
+
+	// views of other proxies are not used
+	watchChan := make(chan core.WatchResponse, 1)
+	go func() {
+		for {
+			select {
+			case <-watchChan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		err := r.membership.KeepAliveAndWatch(ctx, info, watchChan)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Println("Register proxy:", err)
+
+		select {
+		case <-time.After(registerRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// drain stops the proxy without failing requests of clients:
+// reports NOT_SERVING and deregisters the proxy, waits for clients to observe it,
+// then ends streams for stopping the server
+func (r *ProxyRoot) drain(registerDone <-chan struct{}) {
+	deadline := time.After(r.shutdownConfig.Timeout)
+
+	fmt.Println("Deregistering")
+	r.health.Shutdown()
+
+	select {
+	case <-registerDone:
+	case <-deadline:
+		fmt.Println("Deregister timeout")
+	}
+
+	select {
+	case <-time.After(r.shutdownConfig.PropagationDelay):
+	case <-deadline:
+	}
+
+	close(r.closeChan)
 }
 
 // GetGRPCAddress ...
 func (r *ProxyRoot) GetGRPCAddress() string {
-	return fmt.Sprintf("localhost:%d", r.proxyConfig.Port)
+	return r.selfConfig.ToAddress()
 }
 
 // GetGPRCListenAddr ...
 func (r *ProxyRoot) GetGPRCListenAddr() string {
-	return fmt.Sprintf(":%d", r.proxyConfig.Port)
+	return r.selfConfig.ToListenAddr()
 }
 
 // GetGPRCGatewayListenAddr ...
 func (r *ProxyRoot) GetGPRCGatewayListenAddr() string {
-	return fmt.Sprintf(":%d", r.proxyConfig.Port+100)
+	return r.selfConfig.ToGatewayListenAddr()
 }
@@ -0,0 +1,168 @@
+package statemachine
+
+import (
+	"container/heap"
+	"container/list"
+	"time"
+)
+
+type cacheEntry struct {
+	entity Entity
+	// heapIndex is the index in the expiry heap, -1 for never expired entities
+	heapIndex int
+}
+
+// expiryHeap is a min heap of cached entities by expiry
+type expiryHeap []*cacheEntry
+
+var _ heap.Interface = &expiryHeap{}
+
+func (h expiryHeap) Len() int {
+	return len(h)
+}
+
+func (h expiryHeap) Less(i, j int) bool {
+	return h[i].entity.EntityExpiredAt().Before(h[j].entity.EntityExpiredAt())
+}
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*cacheEntry)
+	e.heapIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	e.heapIndex = -1
+	return e
+}
+
+// entityCache is a LRU cache of entities, not thread safe
+type entityCache struct {
+	capacity int
+	lruList  *list.List
+	elemMap  map[Key]*list.Element
+	expiry   expiryHeap
+}
+
+func newEntityCache(capacity int) *entityCache {
+	return &entityCache{
+		capacity: capacity,
+		lruList:  list.New(),
+		elemMap:  make(map[Key]*list.Element),
+	}
+}
+
+func (c *entityCache) get(key Key) (Entity, bool) {
+	elem, existed := c.elemMap[key]
+	if !existed {
+		return nil, false
+	}
+	c.lruList.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).entity, true
+}
+
+func (c *entityCache) put(entity Entity) {
+	key := entity.EntityKey()
+	expiredAt := entity.EntityExpiredAt()
+
+	elem, existed := c.elemMap[key]
+	if !existed {
+		e := &cacheEntry{entity: entity, heapIndex: -1}
+		c.elemMap[key] = c.lruList.PushFront(e)
+		if !expiredAt.IsZero() {
+			heap.Push(&c.expiry, e)
+		}
+		return
+	}
+
+	e := elem.Value.(*cacheEntry)
+	e.entity = entity
+	c.lruList.MoveToFront(elem)
+
+	switch {
+	case expiredAt.IsZero():
+		c.removeExpiry(e)
+	case e.heapIndex < 0:
+		heap.Push(&c.expiry, e)
+	default:
+		heap.Fix(&c.expiry, e.heapIndex)
+	}
+}
+
+func (c *entityCache) removeExpiry(e *cacheEntry) {
+	if e.heapIndex < 0 {
+		return
+	}
+	heap.Remove(&c.expiry, e.heapIndex)
+}
+
+func (c *entityCache) remove(elem *list.Element) {
+	e := elem.Value.(*cacheEntry)
+	c.removeExpiry(e)
+	c.lruList.Remove(elem)
+	delete(c.elemMap, e.entity.EntityKey())
+}
+
+func (c *entityCache) delete(key Key) {
+	elem, existed := c.elemMap[key]
+	if !existed {
+		return
+	}
+	c.remove(elem)
+}
+
+func (c *entityCache) len() int {
+	return len(c.elemMap)
+}
+
+// evict removes the least recently used entities until the size is not over capacity
+func (c *entityCache) evict() {
+	for len(c.elemMap) > c.capacity {
+		c.remove(c.lruList.Back())
+	}
+}
+
+// forEach iterates over entities without changing the recency
+func (c *entityCache) forEach(fn func(entity Entity)) {
+	for elem := c.lruList.Front(); elem != nil; {
+		next := elem.Next()
+		fn(elem.Value.(*cacheEntry).entity)
+		elem = next
+	}
+}
+
+// hasExpired returns true if any entity is expired at now
+func (c *entityCache) hasExpired(now time.Time) bool {
+	return len(c.expiry) > 0 && !now.Before(c.expiry[0].entity.EntityExpiredAt())
+}
+
+// forEachExpired iterates over entities expired at now without scanning others,
+// stops when fn returns false
+func (c *entityCache) forEachExpired(now time.Time, fn func(entity Entity) bool) {
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		if i >= len(c.expiry) {
+			return true
+		}
+		e := c.expiry[i]
+		if now.Before(e.entity.EntityExpiredAt()) {
+			// children of the heap expire later
+			return true
+		}
+		if !fn(e.entity) {
+			return false
+		}
+		return visit(2*i+1) && visit(2*i+2)
+	}
+	visit(0)
+}
@@ -0,0 +1,72 @@
+package statemachine
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntityCache_ForEachExpired(t *testing.T) {
+	now := time.Now()
+
+	c := newEntityCache(4)
+	c.put(testEntity{key: 10, expiredAt: now.Add(-3 * time.Second)})
+	c.put(testEntity{key: 11, expiredAt: now.Add(time.Second)})
+	c.put(testEntity{key: 12})
+	c.put(testEntity{key: 13, expiredAt: now.Add(-time.Second)})
+	c.put(testEntity{key: 14, expiredAt: now.Add(-2 * time.Second)})
+
+	// refreshed, never expired
+	c.put(testEntity{key: 13})
+	// 10 is evicted
+	c.evict()
+
+	var keys []Key
+	c.forEachExpired(now, func(e Entity) bool {
+		keys = append(keys, e.EntityKey())
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	assert.Equal(t, []Key{14}, keys)
+	assert.Equal(t, 2, len(c.expiry))
+
+	c.delete(14)
+	keys = nil
+	c.forEachExpired(now.Add(2*time.Second), func(e Entity) bool {
+		keys = append(keys, e.EntityKey())
+		return true
+	})
+	assert.Equal(t, []Key{11}, keys)
+}
+
+func TestEntityCache_EvictLeastRecentlyUsed(t *testing.T) {
+	c := newEntityCache(3)
+	c.put(testEntity{key: 10})
+	c.put(testEntity{key: 11})
+	c.put(testEntity{key: 12})
+
+	// 10 is used again, 11 becomes the least recently used
+	_, ok := c.get(10)
+	assert.Equal(t, true, ok)
+	c.put(testEntity{key: 13, expiredAt: time.Now()})
+	c.evict()
+
+	assert.Equal(t, 3, c.len())
+	_, ok = c.get(11)
+	assert.Equal(t, false, ok)
+
+	// the expired entity is also removed from the expiry heap when evicted
+	c.put(testEntity{key: 14})
+	c.put(testEntity{key: 15})
+	c.put(testEntity{key: 16})
+	c.evict()
+
+	var keys []Key
+	c.forEach(func(e Entity) {
+		keys = append(keys, e.EntityKey())
+	})
+	assert.Equal(t, []Key{16, 15, 14}, keys)
+	assert.Equal(t, 0, len(c.expiry))
+}
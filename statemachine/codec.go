@@ -0,0 +1,124 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var errCorruptedData = errors.New("corrupted data")
+
+// Encoder appends values in little endian
+type Encoder struct {
+	buf []byte
+}
+
+// Bytes returns the encoded data
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+// Uint8 ...
+func (e *Encoder) Uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+// Uint16 ...
+func (e *Encoder) Uint16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+// Uint32 ...
+func (e *Encoder) Uint32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+// Uint64 ...
+func (e *Encoder) Uint64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+// ShortString encodes a string shorter than 64KB with its length in 2 bytes
+func (e *Encoder) ShortString(s string) {
+	e.Uint16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// Time encodes the zero time as 0
+func (e *Encoder) Time(t time.Time) {
+	if t.IsZero() {
+		e.Uint64(0)
+		return
+	}
+	e.Uint64(uint64(t.UnixNano()))
+}
+
+// Decoder reads values in little endian, the first error is kept
+type Decoder struct {
+	buf []byte
+	err error
+}
+
+// NewDecoder creates a Decoder of the data
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{buf: data}
+}
+
+// Err returns the first error
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+func (d *Decoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if len(d.buf) < n {
+		d.err = errCorruptedData
+		return make([]byte, n)
+	}
+	result := d.buf[:n]
+	d.buf = d.buf[n:]
+	return result
+}
+
+// Uint8 ...
+func (d *Decoder) Uint8() uint8 {
+	return d.next(1)[0]
+}
+
+// Uint16 ...
+func (d *Decoder) Uint16() uint16 {
+	return binary.LittleEndian.Uint16(d.next(2))
+}
+
+// Uint32 ...
+func (d *Decoder) Uint32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+// Uint64 ...
+func (d *Decoder) Uint64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+// ShortString ...
+func (d *Decoder) ShortString() string {
+	n := d.Uint16()
+	return string(d.next(int(n)))
+}
+
+// Time ...
+func (d *Decoder) Time() time.Time {
+	v := d.Uint64()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(v))
+}
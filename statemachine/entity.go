@@ -0,0 +1,142 @@
+package statemachine
+
+import (
+	"context"
+	"sharding/core"
+	"time"
+)
+
+type (
+	// Key identifies an entity of a domain
+	Key uint64
+
+	// Entity is the state of an entity persisted as a versioned row, implemented by value types
+	Entity interface {
+		// EntityKey identifies the entity
+		EntityKey() Key
+		// EntityVersion is the version of the persisted row, zero for never persisted
+		EntityVersion() uint32
+		// EntityExpiredAt is zero for never expired entities
+		EntityExpiredAt() time.Time
+		// WithEntityVersion returns a copy with the version replaced
+		WithEntityVersion(version uint32) Entity
+	}
+
+	// Domain is the logic of the entities of a Store
+	Domain interface {
+		// Hash of the entity, the same as the hash of its commands
+		Hash(key Key) core.Hash
+		// NewEntity returns the state of a not existed entity, keeping the version of its deleted row
+		NewEntity(key Key, version uint32) Entity
+		// Apply applies commands in order against the state, returns an event per command.
+		// It must be pure, entities are only read and changed through the state.
+		// Only commands of entities owned by the node are applied, others are replied ErrNotOwner
+		Apply(state *State, cmds []Command) []Event
+
+		// EncodeEntity and DecodeEntity are used by the WAL and snapshots
+		EncodeEntity(e *Encoder, entity Entity)
+		DecodeEntity(d *Decoder) Entity
+		// EntitySize estimates the size of the entity in bytes, for metrics of unflushed entities
+		EntitySize(entity Entity) int
+	}
+
+	// Repository persists entities of a domain, versions of rows detect changes by other nodes
+	Repository interface {
+		// GetByHashRanges returns at most limit entities with hashes in the ranges
+		GetByHashRanges(ctx context.Context, ranges []core.HashRange, limit int) ([]Entity, error)
+		// Get returns existing entities of the keys
+		Get(ctx context.Context, keys []Key) ([]Entity, error)
+
+		Transact(ctx context.Context, fn func(ctx context.Context, tx TxRepository) error) error
+	}
+
+	// TxRepository interface for transactions
+	TxRepository interface {
+		// Upsert stores entities with their versions increased,
+		// returns ErrCommandAborted if the versions of existing rows are mismatched
+		Upsert(ctx context.Context, entities []Entity) error
+		// Delete returns ErrCommandAborted if versions are mismatched
+		Delete(ctx context.Context, deletes []Deletion) error
+		// DeleteExpired deletes at most limit entities in the ranges expired at now
+		DeleteExpired(ctx context.Context, ranges []core.HashRange, now time.Time, limit int) error
+	}
+
+	// Deletion of an entity, Version is zero for never persisted entities
+	Deletion struct {
+		Key     Key
+		Version uint32
+	}
+)
+
+func entityExpired(e Entity, now time.Time) bool {
+	expiredAt := e.EntityExpiredAt()
+	return !expiredAt.IsZero() && !now.Before(expiredAt)
+}
+
+// State keeps entities during applying a batch
+type State struct {
+	now       time.Time
+	newEntity func(key Key, version uint32) Entity
+
+	entities map[Key]Entity
+	updates  map[Key]Entity
+	deletes  map[Key]uint32
+}
+
+// NewState creates a State of the entities, changes are written back into the map
+func NewState(now time.Time, newEntity func(key Key, version uint32) Entity, entities map[Key]Entity) *State {
+	return &State{
+		now:       now,
+		newEntity: newEntity,
+		entities:  entities,
+		updates:   make(map[Key]Entity),
+		deletes:   make(map[Key]uint32),
+	}
+}
+
+// Now is the time of the batch
+func (s *State) Now() time.Time {
+	return s.now
+}
+
+// Get returns the current state, an expired or deleted entity is new but keeps its version
+func (s *State) Get(key Key) Entity {
+	e, existed := s.entities[key]
+	if !existed {
+		return s.newEntity(key, s.deletes[key])
+	}
+	if entityExpired(e, s.now) {
+		return s.newEntity(key, e.EntityVersion())
+	}
+	return e
+}
+
+// Put changes the entity
+func (s *State) Put(e Entity) {
+	key := e.EntityKey()
+	delete(s.deletes, key)
+	s.entities[key] = e
+	s.updates[key] = e
+}
+
+// Delete deletes the entity if existed
+func (s *State) Delete(key Key) {
+	e, existed := s.entities[key]
+	if !existed {
+		return
+	}
+
+	delete(s.entities, key)
+	delete(s.updates, key)
+	s.deletes[key] = e.EntityVersion()
+}
+
+// Updates returns new states of changed entities, versions are increased after persisted
+func (s *State) Updates() map[Key]Entity {
+	return s.updates
+}
+
+// Deletes returns versions of deleted entities
+func (s *State) Deletes() map[Key]uint32 {
+	return s.deletes
+}
@@ -0,0 +1,351 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"sharding/core"
+	"time"
+)
+
+// pendingEntity is an entity changed in memory but not yet persisted,
+// a deleted entity is kept as a new entity with the version of the deleted row
+type pendingEntity struct {
+	entity  Entity
+	deleted bool
+	seq     uint64
+}
+
+type flushResult struct {
+	flushed map[Key]pendingEntity
+	// walSegment is the first WAL segment not covered by the flush, zero for none
+	walSegment uint64
+	err        error
+}
+
+// flusher persists entities in background for the write behind mode,
+// all methods except the flushing goroutine are called by the store goroutine
+type flusher struct {
+	repo   Repository
+	domain Domain
+	wal    *wal
+	name   string
+	shard  string
+
+	seq          uint64
+	pending      map[Key]pendingEntity
+	pendingBytes int
+	inFlight     bool
+	// lastErr is the error of the last flush
+	lastErr error
+
+	// expired rows of the ranges are deleted by the next flush if expireAt is not zero,
+	// for entities not in the cache
+	expireRanges []core.HashRange
+	expireAt     time.Time
+}
+
+func newFlusher(repo Repository, domain Domain, name string, shard string) *flusher {
+	return &flusher{
+		repo:    repo,
+		domain:  domain,
+		name:    name,
+		shard:   shard,
+		pending: make(map[Key]pendingEntity),
+	}
+}
+
+func (f *flusher) get(key Key) (pendingEntity, bool) {
+	p, existed := f.pending[key]
+	return p, existed
+}
+
+func (f *flusher) set(key Key, p pendingEntity) {
+	old, existed := f.pending[key]
+	if existed {
+		f.pendingBytes -= f.domain.EntitySize(old.entity)
+	}
+	f.pending[key] = p
+	f.pendingBytes += f.domain.EntitySize(p.entity)
+}
+
+func (f *flusher) remove(key Key) {
+	old, existed := f.pending[key]
+	if !existed {
+		return
+	}
+	f.pendingBytes -= f.domain.EntitySize(old.entity)
+	delete(f.pending, key)
+}
+
+func (f *flusher) updateMetrics() {
+	unflushedEntities.WithLabelValues(f.name, f.shard).Set(float64(len(f.pending)))
+	unflushedBytes.WithLabelValues(f.name, f.shard).Set(float64(f.pendingBytes))
+}
+
+func (f *flusher) add(res applyResult) {
+	for key, version := range res.deletes {
+		f.seq++
+		f.set(key, pendingEntity{
+			entity:  f.domain.NewEntity(key, version),
+			deleted: true,
+			seq:     f.seq,
+		})
+	}
+
+	for key, entity := range res.updates {
+		f.seq++
+		f.set(key, pendingEntity{
+			entity: entity,
+			seq:    f.seq,
+		})
+	}
+
+	f.updateMetrics()
+}
+
+// scheduleExpire lets the next flush delete expired rows of the ranges
+func (f *flusher) scheduleExpire(ranges []core.HashRange, now time.Time) {
+	f.expireRanges = ranges
+	f.expireAt = now
+}
+
+func (f *flusher) cancelExpire() {
+	f.expireRanges = nil
+	f.expireAt = time.Time{}
+}
+
+// startFlush persists pending entities in background, done is called by the flushing goroutine
+func (f *flusher) startFlush(done func(res flushResult)) {
+	if f.inFlight || (len(f.pending) == 0 && f.expireAt.IsZero()) {
+		return
+	}
+	f.inFlight = true
+
+	expireRanges := f.expireRanges
+	expireAt := f.expireAt
+	f.cancelExpire()
+
+	flushed := make(map[Key]pendingEntity, len(f.pending))
+	var upserts []Entity
+	var deletes []Deletion
+	for key, p := range f.pending {
+		flushed[key] = p
+		if p.deleted {
+			deletes = append(deletes, Deletion{Key: key, Version: p.entity.EntityVersion()})
+		} else {
+			upserts = append(upserts, p.entity)
+		}
+	}
+
+	// changes logged into previous segments are all in the pending map
+	var walSegment uint64
+	if f.wal != nil {
+		err := f.wal.rotate()
+		if err != nil {
+			fmt.Println("WAL rotate:", err)
+		} else {
+			walSegment = f.wal.segment
+		}
+	}
+
+	go func() {
+		ctx := context.Background()
+		err := f.repo.Transact(ctx, func(ctx context.Context, tx TxRepository) error {
+			err := tx.Delete(ctx, deletes)
+			if err != nil {
+				return err
+			}
+
+			if !expireAt.IsZero() {
+				err := tx.DeleteExpired(ctx, expireRanges, expireAt, expireBatchSize)
+				if err != nil {
+					return err
+				}
+			}
+
+			return tx.Upsert(ctx, upserts)
+		})
+
+		done(flushResult{
+			flushed:    flushed,
+			walSegment: walSegment,
+			err:        err,
+		})
+	}()
+}
+
+func (f *flusher) removeWALSegments(res flushResult) {
+	if f.wal == nil || res.walSegment == 0 {
+		return
+	}
+	err := f.wal.removeUntil(res.walSegment)
+	if err != nil {
+		fmt.Println("WAL remove:", err)
+	}
+}
+
+// recover replays WAL entries not yet persisted into the pending map
+func (f *flusher) recover(ctx context.Context, entries []walEntry) error {
+	latest := make(map[Key]walEntry)
+	keys := make([]Key, 0, len(entries))
+	for _, e := range entries {
+		key := e.entity.EntityKey()
+		if _, existed := latest[key]; !existed {
+			keys = append(keys, key)
+		}
+		latest[key] = e
+	}
+
+	entities, err := f.repo.Get(ctx, keys)
+	if err != nil {
+		return err
+	}
+	versions := make(map[Key]uint32)
+	for _, entity := range entities {
+		versions[entity.EntityKey()] = entity.EntityVersion()
+	}
+
+	for _, key := range keys {
+		e := latest[key]
+		version := e.entity.EntityVersion()
+		// persisted or changed by other nodes
+		if versions[key] != version {
+			continue
+		}
+		if e.deleted && version == 0 {
+			continue
+		}
+
+		f.seq++
+		f.set(key, pendingEntity{
+			entity:  e.entity,
+			deleted: e.deleted,
+			seq:     f.seq,
+		})
+	}
+
+	fmt.Println("WAL recovered", len(f.pending), "entities")
+	f.updateMetrics()
+	return nil
+}
+
+// completeFlush passes the result to the store goroutine
+func (s *store) completeFlush(res flushResult) {
+	s.completionChan <- func() error {
+		s.handleFlushResult(res)
+		return nil
+	}
+}
+
+func (s *store) handleFlushResult(res flushResult) {
+	f := s.flusher
+	f.inFlight = false
+	f.lastErr = nil
+
+	if res.err == ErrCommandAborted {
+		s.resolveFlushConflicts(res)
+		return
+	}
+	if res.err != nil {
+		fmt.Println("Flush:", res.err)
+		f.lastErr = res.err
+		return
+	}
+
+	for key, flushed := range res.flushed {
+		current, existed := f.pending[key]
+		if existed && current.seq == flushed.seq {
+			f.remove(key)
+		}
+
+		if flushed.deleted {
+			continue
+		}
+
+		flushedVersion := flushed.entity.EntityVersion()
+		newVersion := flushedVersion + 1
+		if existed && current.seq != flushed.seq && current.entity.EntityVersion() == flushedVersion {
+			current.entity = current.entity.WithEntityVersion(newVersion)
+			f.pending[key] = current
+		}
+
+		entity, ok := s.cache.get(key)
+		if ok && entity.EntityVersion() == flushedVersion {
+			s.cache.put(entity.WithEntityVersion(newVersion))
+		}
+	}
+	f.removeWALSegments(res)
+	f.updateMetrics()
+}
+
+// resolveFlushConflicts reloads entities of the aborted flush, drops only the pending entities
+// changed by other nodes, then retries the flush of the remaining ones.
+// WAL segments are kept until a retry succeeded
+func (s *store) resolveFlushConflicts(res flushResult) {
+	f := s.flusher
+
+	keys := make([]Key, 0, len(res.flushed))
+	flushedRes := applyResult{
+		updates: make(map[Key]Entity),
+		deletes: make(map[Key]uint32),
+	}
+	for key, p := range res.flushed {
+		keys = append(keys, key)
+		if p.deleted {
+			flushedRes.deletes[key] = p.entity.EntityVersion()
+		} else {
+			flushedRes.updates[key] = p.entity
+		}
+	}
+
+	entities, err := f.repo.Get(context.Background(), keys)
+	if err != nil {
+		fmt.Println("Resolve flush conflicts:", err)
+		f.lastErr = err
+		return
+	}
+
+	conflicts := findConflicts(s.domain, flushedRes, entities)
+	if len(conflicts) == 0 {
+		// retried by the next flush
+		f.lastErr = res.err
+		return
+	}
+
+	fmt.Println("Flush conflicted, drop", len(conflicts), "entities")
+	for key, fresh := range conflicts {
+		// newer pending changes of the key are also based on the stale entity
+		f.remove(key)
+		s.cache.put(fresh)
+	}
+	s.cache.evict()
+	droppedEntities.WithLabelValues(f.name, f.shard).Add(float64(len(conflicts)))
+	f.updateMetrics()
+
+	if len(f.pending) == 0 {
+		f.removeWALSegments(res)
+		return
+	}
+	f.startFlush(s.completeFlush)
+}
+
+// flushAll waits until all pending entities are persisted
+func (s *store) flushAll() error {
+	f := s.flusher
+	for {
+		if !f.inFlight {
+			if len(f.pending) == 0 {
+				return nil
+			}
+			f.startFlush(s.completeFlush)
+		}
+
+		err := s.runCompletion()
+		if err != nil {
+			return err
+		}
+		if !f.inFlight && f.lastErr != nil {
+			return f.lastErr
+		}
+	}
+}
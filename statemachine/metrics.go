@@ -0,0 +1,43 @@
+package statemachine
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sharding",
+		Subsystem: "processor",
+		Name:      "queue_depth",
+		Help:      "Number of commands waiting in the command channel",
+	}, []string{"domain", "shard"})
+
+	rejectedCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sharding",
+		Subsystem: "processor",
+		Name:      "rejected_commands_total",
+		Help:      "Number of commands rejected by admission control",
+	}, []string{"domain"})
+
+	unflushedEntities = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sharding",
+		Subsystem: "processor",
+		Name:      "unflushed_entities",
+		Help:      "Number of entities changed in memory but not yet persisted",
+	}, []string{"domain", "shard"})
+
+	unflushedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sharding",
+		Subsystem: "processor",
+		Name:      "unflushed_bytes",
+		Help:      "Estimated size of entities changed in memory but not yet persisted",
+	}, []string{"domain", "shard"})
+
+	droppedEntities = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sharding",
+		Subsystem: "processor",
+		Name:      "dropped_entities_total",
+		Help:      "Number of unflushed entities dropped for being changed by other nodes",
+	}, []string{"domain", "shard"})
+)
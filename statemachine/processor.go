@@ -0,0 +1,252 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"sharding/core"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// processor runs the state machine of a shard in one goroutine
+type processor struct {
+	// requestCost is the moving average of processing time per request in nanoseconds,
+	// accessed atomically
+	requestCost int64
+
+	cfg     Config
+	shard   Shard
+	label   string
+	sm      StateMachine
+	reqChan chan *Request
+
+	initialized bool
+}
+
+func newProcessor(cfg Config, shard Shard, sm StateMachine, queueSize int) *processor {
+	return &processor{
+		cfg:     cfg,
+		shard:   shard,
+		label:   strconv.Itoa(shard.Index),
+		sm:      sm,
+		reqChan: make(chan *Request, queueSize),
+	}
+}
+
+// estimatedRequestCost is safe to call from other goroutines
+func (p *processor) estimatedRequestCost() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.requestCost))
+}
+
+func (p *processor) updateRequestCost(numRequests int, d time.Duration) {
+	if numRequests == 0 {
+		return
+	}
+	sample := int64(d) / int64(numRequests)
+	old := atomic.LoadInt64(&p.requestCost)
+	atomic.StoreInt64(&p.requestCost, old+(sample-old)/8)
+}
+
+// startTimers sends indices of timers into the returned channel, a tick is dropped if busy
+func startTimers(ctx context.Context, timers []Timer) <-chan int {
+	tickChan := make(chan int, len(timers))
+	for i, t := range timers {
+		if t.Interval <= 0 {
+			continue
+		}
+
+		index := i
+		ticker := time.NewTicker(t.Interval)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					select {
+					case tickChan <- index:
+					default:
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return tickChan
+}
+
+func (p *processor) process(ctx context.Context, watchChan <-chan core.WatchResponse) error {
+	if !p.initialized {
+		err := p.sm.Init(ctx)
+		if err != nil {
+			return err
+		}
+		p.initialized = true
+	}
+
+	timerCtx, cancelTimers := context.WithCancel(context.Background())
+	defer cancelTimers()
+
+	timers := p.sm.Timers()
+	tickChan := startTimers(timerCtx, timers)
+
+	reqs := make([]*Request, 0, p.cfg.MaxBatchSize)
+	for {
+		select {
+		case first := <-p.reqChan:
+			reqs = append(reqs, first)
+
+		case i := <-tickChan:
+			err := timers[i].Fn()
+			if err != nil {
+				return p.sm.Stop(err)
+			}
+			continue
+
+		case fn := <-p.sm.Completions():
+			err := fn()
+			if err != nil {
+				return p.sm.Stop(err)
+			}
+			continue
+
+		case wr := <-watchChan:
+			err := p.sm.HandleWatch(wr)
+			if err != nil {
+				return p.sm.Stop(err)
+			}
+			continue
+
+		case <-ctx.Done():
+			return p.sm.Stop(p.drain(ctx.Err()))
+		}
+
+		var timeout <-chan time.Time
+		if p.cfg.BatchDelay > 0 {
+			timeout = time.After(p.cfg.BatchDelay)
+		}
+
+		reqs, collectErr := p.collectBatch(ctx, reqs, watchChan, timeout)
+		if collectErr != nil && collectErr != ctx.Err() {
+			return p.sm.Stop(collectErr)
+		}
+
+		err := p.apply(reqs)
+		if err != nil {
+			return p.sm.Stop(err)
+		}
+
+		for i := range reqs {
+			reqs[i] = nil
+		}
+		reqs = reqs[:0]
+
+		if collectErr != nil {
+			return p.sm.Stop(p.drain(collectErr))
+		}
+	}
+}
+
+// collectBatch collects available requests,
+// waits for more requests until timeout if it is not nil
+func (p *processor) collectBatch(
+	ctx context.Context, reqs []*Request,
+	watchChan <-chan core.WatchResponse, timeout <-chan time.Time,
+) ([]*Request, error) {
+	for len(reqs) < p.cfg.MaxBatchSize {
+		if timeout == nil {
+			select {
+			case r := <-p.reqChan:
+				reqs = append(reqs, r)
+
+			case wr := <-watchChan:
+				err := p.sm.HandleWatch(wr)
+				if err != nil {
+					return reqs, err
+				}
+
+			case <-ctx.Done():
+				return reqs, ctx.Err()
+
+			default:
+				return reqs, nil
+			}
+			continue
+		}
+
+		select {
+		case r := <-p.reqChan:
+			reqs = append(reqs, r)
+
+		case wr := <-watchChan:
+			err := p.sm.HandleWatch(wr)
+			if err != nil {
+				return reqs, err
+			}
+
+		case <-ctx.Done():
+			return reqs, ctx.Err()
+
+		case <-timeout:
+			return reqs, nil
+		}
+	}
+	return reqs, nil
+}
+
+// drain applies requests queued before it is called, returns err if succeeded
+func (p *processor) drain(err error) error {
+	remaining := len(p.reqChan)
+	if remaining > 0 {
+		fmt.Println("Draining", remaining, "requests")
+	}
+
+	reqs := make([]*Request, 0, p.cfg.MaxBatchSize)
+	for remaining > 0 {
+		for len(reqs) < p.cfg.MaxBatchSize && remaining > 0 {
+			reqs = append(reqs, <-p.reqChan)
+			remaining--
+		}
+
+		applyErr := p.apply(reqs)
+		if applyErr != nil {
+			return applyErr
+		}
+		reqs = reqs[:0]
+	}
+	return err
+}
+
+func (p *processor) apply(reqs []*Request) error {
+	now := time.Now()
+	queueDepth.WithLabelValues(p.cfg.Name, p.label).Set(float64(len(p.reqChan)))
+
+	reqs = skipAbortedRequests(reqs, now)
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	err := p.sm.Apply(reqs)
+	p.updateRequestCost(len(reqs), time.Since(now))
+	return err
+}
+
+// skipAbortedRequests replies to aborted requests, returns the remaining ones
+func skipAbortedRequests(reqs []*Request, now time.Time) []*Request {
+	result := reqs[:0]
+	for _, r := range reqs {
+		err := r.abortedError(now)
+		if err != nil {
+			r.Fail(err)
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// SkipAbortedRequests is used by state machines for re-applying requests
+func SkipAbortedRequests(reqs []*Request) []*Request {
+	return skipAbortedRequests(reqs, time.Now())
+}
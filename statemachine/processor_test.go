@@ -0,0 +1,196 @@
+package statemachine
+
+import (
+	"context"
+	"math"
+	"sharding/core"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCommand struct {
+	hash core.Hash
+}
+
+func (c testCommand) Hash() core.Hash {
+	return c.hash
+}
+
+func (c testCommand) Key() Key {
+	return Key(c.hash)
+}
+
+func TestSkipAbortedRequests(t *testing.T) {
+	now := time.Now()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expired := NewRequest(context.Background(), testCommand{hash: 11})
+	expired.deadline = now.Add(-time.Second)
+
+	notExpired := NewRequest(context.Background(), testCommand{hash: 13})
+	notExpired.deadline = now.Add(time.Second)
+
+	aborted := NewRequest(canceled, testCommand{hash: 12})
+
+	result := skipAbortedRequests([]*Request{
+		NewRequest(context.Background(), testCommand{hash: 10}),
+		expired,
+		aborted,
+		notExpired,
+	}, now)
+
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, core.Hash(10), result[0].Command.Hash())
+	assert.Equal(t, core.Hash(13), result[1].Command.Hash())
+
+	assert.Equal(t, Reply{Err: ErrCommandTimeout}, <-expired.replyChan)
+	assert.Equal(t, Reply{Err: ErrClientAborted}, <-aborted.replyChan)
+}
+
+func TestRuntime_SendNotBlocked(t *testing.T) {
+	r := NewRuntime(Config{MaxBatchSize: 1}, func(shard Shard) StateMachine {
+		return nil
+	})
+
+	// the queue size is twice the batch size
+	assert.Equal(t, nil, r.send(NewRequest(context.Background(), testCommand{hash: 10})))
+	assert.Equal(t, nil, r.send(NewRequest(context.Background(), testCommand{hash: 11})))
+	assert.Equal(t, ErrTooManyRequests, r.send(NewRequest(context.Background(), testCommand{hash: 12})))
+
+	// not waiting for senders
+	r.Close()
+	assert.Equal(t, ErrNotOwner, r.send(NewRequest(context.Background(), testCommand{hash: 13})))
+}
+
+func TestRuntime_Drain(t *testing.T) {
+	tx := &fakeTx{}
+	s := newTestStore(StoreConfig{WriteBehind: true}, &fakeRepo{tx: tx})
+	s.nodes = []core.NodeInfo{{NodeID: 1, Hash: math.MaxUint32}}
+	s.ownedRanges = s.shard.OwnedRanges(s.nodes)
+
+	r := NewRuntime(Config{SelfNodeID: 1, MaxBatchSize: 10}, func(shard Shard) StateMachine {
+		return s
+	})
+
+	queued := []*Request{
+		NewRequest(context.Background(), testIncrease{key: 10}),
+		NewRequest(context.Background(), testIncrease{key: 10}),
+	}
+	for _, req := range queued {
+		assert.Equal(t, nil, r.send(req))
+	}
+
+	// new commands are forwarded to the new owners after deregistered
+	r.Close()
+	_, err := r.Execute(context.Background(), testIncrease{key: 10})
+	assert.Equal(t, ErrNotOwner, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = r.Process(ctx, make(chan core.WatchResponse))
+	assert.Equal(t, context.Canceled, err)
+
+	for i, req := range queued {
+		ev, err := req.Wait(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint32(i+1), ev)
+	}
+
+	// persisted before stopped
+	assert.Equal(t, [][]Entity{{testEntity{key: 10, value: 2}}}, tx.upserted)
+	assert.Equal(t, 0, len(s.flusher.pending))
+}
+
+func TestRuntime_Admit(t *testing.T) {
+	table := []struct {
+		name          string
+		maxQueueDepth int
+		maxQueueWait  time.Duration
+		depth         int
+		requestCost   time.Duration
+		err           error
+	}{
+		{
+			name:  "unlimited",
+			depth: 5,
+		},
+		{
+			name:          "below-depth",
+			maxQueueDepth: 3,
+			depth:         2,
+		},
+		{
+			name:          "depth",
+			maxQueueDepth: 3,
+			depth:         3,
+			err:           ErrTooManyRequests,
+		},
+		{
+			name:         "below-wait",
+			maxQueueWait: 30 * time.Millisecond,
+			depth:        3,
+			requestCost:  10 * time.Millisecond,
+		},
+		{
+			name:         "wait",
+			maxQueueWait: 20 * time.Millisecond,
+			depth:        3,
+			requestCost:  10 * time.Millisecond,
+			err:          ErrTooManyRequests,
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			name := "admit-" + e.name
+			r := NewRuntime(Config{
+				Name:          name,
+				MaxBatchSize:  10,
+				MaxQueueDepth: e.maxQueueDepth,
+				MaxQueueWait:  e.maxQueueWait,
+			}, func(shard Shard) StateMachine {
+				return nil
+			})
+
+			p := r.processors[0]
+			p.requestCost = int64(e.requestCost)
+			for i := 0; i < e.depth; i++ {
+				p.reqChan <- NewRequest(context.Background(), testCommand{hash: 10})
+			}
+
+			rejected := rejectedCommands.WithLabelValues(name)
+			rejectedBefore := testutil.ToFloat64(rejected)
+
+			assert.Equal(t, e.err, r.admit(p))
+			if e.err != nil {
+				assert.Equal(t, rejectedBefore+1, testutil.ToFloat64(rejected))
+			} else {
+				assert.Equal(t, rejectedBefore, testutil.ToFloat64(rejected))
+			}
+		})
+	}
+}
+
+func TestProcessor_QueueDepthGauge(t *testing.T) {
+	s := newTestStore(StoreConfig{WriteBehind: true}, &fakeRepo{})
+	s.nodes = []core.NodeInfo{{NodeID: 1, Hash: math.MaxUint32}}
+
+	p := newProcessor(Config{Name: "queue-depth", MaxBatchSize: 10}, s.shard, s, 10)
+	for i := 0; i < 3; i++ {
+		p.reqChan <- NewRequest(context.Background(), testIncrease{key: 10})
+	}
+
+	req := NewRequest(context.Background(), testIncrease{key: 10})
+	err := p.apply([]*Request{req})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, float64(3), testutil.ToFloat64(queueDepth.WithLabelValues("queue-depth", "0")))
+
+	err = p.apply([]*Request{<-p.reqChan})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, float64(2), testutil.ToFloat64(queueDepth.WithLabelValues("queue-depth", "0")))
+}
@@ -0,0 +1,200 @@
+package statemachine
+
+import (
+	"context"
+	"sharding/core"
+	"sync"
+	"time"
+)
+
+// Runtime routes commands to shards of a node by hash
+type Runtime struct {
+	cfg        Config
+	processors []*processor
+
+	mut    sync.RWMutex
+	closed bool
+	// nodes of the ring, updated before passed to shards
+	nodes []core.NodeInfo
+}
+
+// NewRuntime creates a Runtime with a state machine per shard
+func NewRuntime(cfg Config, newStateMachine func(shard Shard) StateMachine) *Runtime {
+	if cfg.Shards < 1 {
+		cfg.Shards = 1
+	}
+
+	queueSize := cfg.MaxBatchSize * 2
+	if cfg.MaxQueueDepth > queueSize {
+		queueSize = cfg.MaxQueueDepth
+	}
+
+	processors := make([]*processor, 0, cfg.Shards)
+	for i := 0; i < cfg.Shards; i++ {
+		shard := Shard{
+			NodeID: cfg.SelfNodeID,
+			Index:  i,
+			Count:  cfg.Shards,
+		}
+		processors = append(processors, newProcessor(cfg, shard, newStateMachine(shard), queueSize))
+	}
+
+	return &Runtime{
+		cfg:        cfg,
+		processors: processors,
+	}
+}
+
+// getProcessor routes by hash, keeping the order of commands of an entity
+func (r *Runtime) getProcessor(hash core.Hash) *processor {
+	return r.processors[shardOf(hash, len(r.processors))]
+}
+
+// admit rejects new requests when the shard is overloaded
+func (r *Runtime) admit(p *processor) error {
+	depth := len(p.reqChan)
+	if r.cfg.MaxQueueDepth > 0 && depth >= r.cfg.MaxQueueDepth {
+		rejectedCommands.WithLabelValues(r.cfg.Name).Inc()
+		return ErrTooManyRequests
+	}
+
+	wait := time.Duration(depth) * p.estimatedRequestCost()
+	if r.cfg.MaxQueueWait > 0 && wait > r.cfg.MaxQueueWait {
+		rejectedCommands.WithLabelValues(r.cfg.Name).Inc()
+		return ErrTooManyRequests
+	}
+	return nil
+}
+
+// withTimeout applies the default timeout if the context has no deadline
+func (r *Runtime) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	_, ok := ctx.Deadline()
+	if ok || r.cfg.CommandTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.cfg.CommandTimeout)
+}
+
+// send never blocks while holding the lock, Close must not wait for a full queue
+func (r *Runtime) send(req *Request) error {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	if r.closed {
+		return ErrNotOwner
+	}
+
+	p := r.getProcessor(req.Command.Hash())
+	err := r.admit(p)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case p.reqChan <- req:
+		return nil
+	default:
+		rejectedCommands.WithLabelValues(r.cfg.Name).Inc()
+		return ErrTooManyRequests
+	}
+}
+
+// Execute sends the command to its shard and waits for the reply
+func (r *Runtime) Execute(ctx context.Context, cmd Command) (Event, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	req := NewRequest(ctx, cmd)
+	err := r.send(req)
+	if err != nil {
+		return nil, err
+	}
+	return req.Wait(ctx)
+}
+
+// IsOwner returns true if the node owns the hash in the latest view of the ring,
+// shards still reject commands not owned in their own view with ErrNotOwner
+func (r *Runtime) IsOwner(hash core.Hash) bool {
+	r.mut.RLock()
+	nodes := r.nodes
+	r.mut.RUnlock()
+
+	nullNodeID := core.GetNodeID(nodes, hash)
+	return nullNodeID.Valid && nullNodeID.NodeID == r.cfg.SelfNodeID
+}
+
+func (r *Runtime) setNodes(nodes []core.NodeInfo) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.nodes = nodes
+}
+
+// Close is called after the node was deregistered, new commands are rejected with ErrNotOwner
+// for being forwarded to the new owners, queued commands are still applied
+// when the context of Process is done
+func (r *Runtime) Close() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.closed = true
+}
+
+// Process runs all shards until the context is done or any of them failed
+func (r *Runtime) Process(ctx context.Context, watchChan <-chan core.WatchResponse) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if len(r.processors) == 1 {
+		shardWatchChan := make(chan core.WatchResponse, 1)
+		go r.fanOutWatch(ctx, watchChan, []chan core.WatchResponse{shardWatchChan})
+		return r.processors[0].process(ctx, shardWatchChan)
+	}
+
+	shardWatchChans := make([]chan core.WatchResponse, 0, len(r.processors))
+	errChan := make(chan error, len(r.processors))
+
+	for _, p := range r.processors {
+		shardWatchChan := make(chan core.WatchResponse, 1)
+		shardWatchChans = append(shardWatchChans, shardWatchChan)
+
+		p := p
+		go func() {
+			errChan <- p.process(ctx, shardWatchChan)
+		}()
+	}
+
+	go r.fanOutWatch(ctx, watchChan, shardWatchChans)
+
+	// stops all shards if any of them failed
+	var firstErr error
+	for range r.processors {
+		err := <-errChan
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return firstErr
+}
+
+func (r *Runtime) fanOutWatch(ctx context.Context, watchChan <-chan core.WatchResponse,
+	shardWatchChans []chan core.WatchResponse,
+) {
+	for {
+		select {
+		case wr := <-watchChan:
+			r.setNodes(wr.Nodes)
+			for _, ch := range shardWatchChans {
+				select {
+				case ch <- wr:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
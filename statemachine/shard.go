@@ -0,0 +1,25 @@
+package statemachine
+
+import (
+	"sharding/core"
+)
+
+// Commands are routed to shards of a node by a static partition of the whole hash space,
+// so an entity always belongs to the same shard when the ring changes.
+// Each shard owns the intersection of the ranges of the node with its partition.
+
+// shardOf returns the index of the partition containing the hash
+func shardOf(hash core.Hash, count int) int {
+	return int(uint64(hash) * uint64(count) >> 32)
+}
+
+// shardRange returns the hash range of the partition, consistent with shardOf
+func shardRange(index int, count int) core.HashRange {
+	n := uint64(count)
+	begin := (uint64(index)<<32 + n - 1) / n
+	end := (uint64(index+1)<<32+n-1)/n - 1
+	return core.HashRange{
+		Begin: core.Hash(begin),
+		End:   core.Hash(end),
+	}
+}
@@ -0,0 +1,25 @@
+package statemachine
+
+import (
+	"math"
+	"sharding/core"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardRange_ConsistentWithShardOf(t *testing.T) {
+	for _, count := range []int{1, 3, 4, 7} {
+		var next uint64
+		for i := 0; i < count; i++ {
+			r := shardRange(i, count)
+			assert.Equal(t, next, uint64(r.Begin))
+			assert.Equal(t, i, shardOf(r.Begin, count))
+			assert.Equal(t, i, shardOf(r.End, count))
+			next = uint64(r.End) + 1
+		}
+		assert.Equal(t, uint64(math.MaxUint32)+1, next)
+	}
+
+	assert.Equal(t, core.HashRange{Begin: 0, End: math.MaxUint32}, shardRange(0, 1))
+}
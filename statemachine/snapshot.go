@@ -0,0 +1,139 @@
+package statemachine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sharding/core"
+	"time"
+)
+
+// Snapshot keeps the in-memory state of a store.
+//
+// File format: magic (4 bytes) | format version (1 byte) | crc32 of body (4 bytes) | body
+// Body format: epoch | saved at | number of nodes (4 bytes) | nodes | number of entities (4 bytes) | entities encoded by the domain
+
+var snapshotMagic = []byte("SHSN")
+
+const snapshotFormatVersion = 1
+
+const snapshotHeaderSize = 9
+
+type snapshot struct {
+	epoch    uint64
+	savedAt  time.Time
+	nodes    []core.NodeInfo
+	entities []Entity
+}
+
+func encodeSnapshot(s snapshot, domain Domain) []byte {
+	e := &Encoder{buf: make([]byte, snapshotHeaderSize, 64+50*len(s.entities))}
+
+	e.Uint64(s.epoch)
+	e.Time(s.savedAt)
+
+	e.Uint32(uint32(len(s.nodes)))
+	for _, n := range s.nodes {
+		e.Uint32(uint32(n.NodeID))
+		e.Uint32(uint32(n.Hash))
+		e.ShortString(n.Address)
+	}
+
+	e.Uint32(uint32(len(s.entities)))
+	for _, entity := range s.entities {
+		domain.EncodeEntity(e, entity)
+	}
+
+	copy(e.buf[0:4], snapshotMagic)
+	e.buf[4] = snapshotFormatVersion
+	binary.LittleEndian.PutUint32(e.buf[5:9], crc32.ChecksumIEEE(e.buf[snapshotHeaderSize:]))
+	return e.buf
+}
+
+func decodeSnapshot(data []byte, domain Domain) (snapshot, error) {
+	if len(data) < snapshotHeaderSize {
+		return snapshot{}, errCorruptedData
+	}
+	if !bytes.Equal(data[0:4], snapshotMagic) || data[4] != snapshotFormatVersion {
+		return snapshot{}, errCorruptedData
+	}
+
+	body := data[snapshotHeaderSize:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[5:9]) {
+		return snapshot{}, errCorruptedData
+	}
+
+	d := &Decoder{buf: body}
+	s := snapshot{
+		epoch:   d.Uint64(),
+		savedAt: d.Time(),
+	}
+
+	numNodes := d.Uint32()
+	for i := uint32(0); i < numNodes && d.err == nil; i++ {
+		s.nodes = append(s.nodes, core.NodeInfo{
+			NodeID:  core.NodeID(d.Uint32()),
+			Hash:    core.Hash(d.Uint32()),
+			Address: d.ShortString(),
+		})
+	}
+
+	numEntities := d.Uint32()
+	if d.err == nil {
+		s.entities = make([]Entity, 0, numEntities)
+	}
+	for i := uint32(0); i < numEntities && d.err == nil; i++ {
+		s.entities = append(s.entities, domain.DecodeEntity(d))
+	}
+
+	if d.err != nil {
+		return snapshot{}, d.err
+	}
+	return s, nil
+}
+
+// writeSnapshotFile replaces the file atomically
+func writeSnapshotFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readSnapshotFile returns false if the file is not existed
+func readSnapshotFile(path string, domain Domain) (snapshot, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snapshot{}, false, nil
+	}
+	if err != nil {
+		return snapshot{}, false, err
+	}
+
+	s, err := decodeSnapshot(data, domain)
+	if err != nil {
+		return snapshot{}, false, err
+	}
+	return s, true, nil
+}
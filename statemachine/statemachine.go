@@ -0,0 +1,203 @@
+// Package statemachine is the runtime for hosting domains on the consistent hashing ring.
+// The runtime routes commands to shards of a node, batches them and handles ring changes.
+// A domain registers its commands, pure apply function and repository by NewStore,
+// which caches, persists and recovers the entities owned by a shard,
+// or implements StateMachine for managing the state by itself.
+package statemachine
+
+import (
+	"context"
+	"sharding/core"
+	"sharding/domain/errors"
+	"time"
+)
+
+type (
+	// Command is applied to the state of an entity
+	Command interface {
+		// Hash of the entity, commands with the same hash are applied in order by one shard
+		Hash() core.Hash
+		// Key of the entity
+		Key() Key
+	}
+
+	// Event is the result of a command
+	Event interface{}
+
+	// Reply of a request
+	Reply struct {
+		Event Event
+		Err   error
+	}
+
+	// Completion is the result of background work, called by the goroutine of the shard
+	Completion func() error
+
+	// Timer calls Fn periodically in the goroutine of the shard, zero Interval for disabled
+	Timer struct {
+		Interval time.Duration
+		Fn       func() error
+	}
+
+	// StateMachine is the state of a domain owned by a shard,
+	// all methods are called by the goroutine of the shard
+	StateMachine interface {
+		// Init is called once before processing any requests
+		Init(ctx context.Context) error
+		// HandleWatch is called when the nodes of the ring changed
+		HandleWatch(wr core.WatchResponse) error
+		// Apply applies a batch of requests, every request must be replied eventually
+		Apply(reqs []*Request) error
+		// Timers returns functions called periodically
+		Timers() []Timer
+		// Completions returns the channel of results of background work
+		Completions() <-chan Completion
+		// Stop is called when the context of Process is done and queued requests were applied,
+		// or after any error, it returns err if stopped successfully
+		Stop(err error) error
+	}
+
+	// Config for configure a Runtime
+	Config struct {
+		// Name of the domain, used for metrics
+		Name       string
+		SelfNodeID core.NodeID
+		// Shards is the number of shards of the node
+		Shards int
+
+		MaxBatchSize int
+		// BatchDelay is the max time waiting for a bigger batch, zero for no waiting
+		BatchDelay time.Duration
+
+		// CommandTimeout is used for requests without deadline
+		CommandTimeout time.Duration
+
+		// requests are rejected when the queue depth or the estimated wait of a shard
+		// exceeds the limits, zero for unlimited, or when the queue of a shard is full
+		MaxQueueDepth int
+		MaxQueueWait  time.Duration
+	}
+)
+
+var (
+	// ErrCommandAborted is returned if the entity was changed by other nodes
+	ErrCommandAborted = errors.New("10000", "Command aborted")
+
+	// ErrNotOwner is returned for entities owned by other nodes
+	ErrNotOwner = errors.New("10003", "Not owner of the entity")
+
+	// ErrCommandTimeout ...
+	ErrCommandTimeout = errors.New("10001", "Command timeout")
+
+	// ErrClientAborted ...
+	ErrClientAborted = errors.New("10002", "Client aborted")
+
+	// ErrTooManyRequests ...
+	ErrTooManyRequests = errors.New("08001", "Too many requests")
+
+	// ErrServiceUnavailable ...
+	ErrServiceUnavailable = errors.New("14001", "Service unavailable")
+
+	// ErrInternal ...
+	ErrInternal = errors.New("13001", "Internal server error")
+
+	// ErrShardingConfig is returned if the node is not in the ring
+	ErrShardingConfig = errors.New("13002", "Sharding configure problem")
+)
+
+// Request is a command with the deadline and the cancellation of the caller context
+type Request struct {
+	Command Command
+
+	deadline  time.Time
+	done      <-chan struct{}
+	replyChan chan Reply
+}
+
+// NewRequest creates a Request, the reply is received by Wait
+func NewRequest(ctx context.Context, cmd Command) *Request {
+	deadline, _ := ctx.Deadline()
+	return &Request{
+		Command:   cmd,
+		deadline:  deadline,
+		done:      ctx.Done(),
+		replyChan: make(chan Reply, 1),
+	}
+}
+
+// abortedError returns non nil if the command must not be applied
+func (r *Request) abortedError(now time.Time) error {
+	select {
+	case <-r.done:
+		return ErrClientAborted
+	default:
+	}
+
+	if !r.deadline.IsZero() && !now.Before(r.deadline) {
+		return ErrCommandTimeout
+	}
+	return nil
+}
+
+// Reply replies the event
+func (r *Request) Reply(e Event) {
+	r.replyChan <- Reply{Event: e}
+}
+
+// Fail replies the error
+func (r *Request) Fail(err error) {
+	r.replyChan <- Reply{Err: err}
+}
+
+// Close is called when the result of the command is unknown
+func (r *Request) Close() {
+	close(r.replyChan)
+}
+
+// Wait waits for the reply
+func (r *Request) Wait(ctx context.Context) (Event, error) {
+	select {
+	case reply, more := <-r.replyChan:
+		return replyToResult(reply, more)
+
+	case <-ctx.Done():
+		// the reply wins if both are ready
+		select {
+		case reply, more := <-r.replyChan:
+			return replyToResult(reply, more)
+		default:
+			return nil, contextError(ctx)
+		}
+	}
+}
+
+func replyToResult(reply Reply, more bool) (Event, error) {
+	if !more {
+		return nil, ErrInternal
+	}
+	return reply.Event, reply.Err
+}
+
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.Canceled {
+		return ErrClientAborted
+	}
+	return ErrCommandTimeout
+}
+
+// Shard describes the partition of the hash space owned by a shard
+type Shard struct {
+	NodeID core.NodeID
+	Index  int
+	Count  int
+}
+
+// Range returns the hash range of the shard
+func (s Shard) Range() core.HashRange {
+	return shardRange(s.Index, s.Count)
+}
+
+// OwnedRanges returns the ranges of the node inside the partition of the shard
+func (s Shard) OwnedRanges(nodes []core.NodeInfo) []core.HashRange {
+	return core.IntersectRanges(core.GetOwnedRanges(nodes, s.NodeID), s.Range())
+}
@@ -0,0 +1,860 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sharding/core"
+	"strconv"
+	"time"
+)
+
+// StoreConfig for configure a store
+type StoreConfig struct {
+	// Name of the domain, used for metrics
+	Name string
+	// CacheSize is the max number of cached entities of the shard
+	CacheSize int
+
+	// WriteBehind replies before entities are persisted, they are flushed every FlushInterval
+	WriteBehind   bool
+	FlushInterval time.Duration
+	// WALDir is only used by the write behind mode, empty for disabled
+	WALDir string
+
+	// SnapshotDir is empty for disabled
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+
+	// ExpireInterval checks expired entities of the cache, zero for disabled
+	ExpireInterval time.Duration
+	// ExpireSweepInterval deletes expired rows not in the cache from the database
+	ExpireSweepInterval time.Duration
+}
+
+// expireBatchSize bounds entities expired per tick in the cache and in the database,
+// the remaining ones are expired by later ticks
+const expireBatchSize = 1000
+
+// reconcileBatchSize bounds keys per query when reconciling the cache
+const reconcileBatchSize = 5000
+
+// store is the state machine of the entities of a domain owned by a shard.
+// Batches are applied by the pure Apply of the domain against the cached entities,
+// then persisted by pipelined commits, or by background flushes in the write behind mode
+type store struct {
+	domain Domain
+	repo   Repository
+	cache  *entityCache
+	cfg    StoreConfig
+
+	nodes       []core.NodeInfo
+	ownedRanges []core.HashRange
+	shard       Shard
+
+	flusher *flusher
+	walDir  string
+
+	// inFlight is the batch being persisted in the sync and group commit modes
+	inFlight *commit
+	// commitAborts counts aborted commits, for detecting changes of the speculative state
+	commitAborts int
+
+	completionChan chan Completion
+
+	epoch        uint64
+	snapshotPath string
+	snapshotSem  chan struct{}
+	// restored is true until entities restored from the snapshot were reconciled with the database
+	restored bool
+	// lastSweep is the last time expired rows were deleted from the database
+	lastSweep time.Time
+
+	initialized bool
+}
+
+var _ StateMachine = &store{}
+
+// NewStore creates the state machine of a shard caching and persisting entities of the domain
+func NewStore(shard Shard, cfg StoreConfig, domain Domain, repo Repository) StateMachine {
+	name := fmt.Sprintf("node-%d", shard.NodeID)
+	if shard.Count > 1 {
+		name = fmt.Sprintf("node-%d-shard-%d", shard.NodeID, shard.Index)
+	}
+
+	var walDir string
+	if cfg.WALDir != "" {
+		walDir = filepath.Join(cfg.WALDir, name)
+	}
+
+	var snapshotPath string
+	if cfg.SnapshotDir != "" {
+		snapshotPath = filepath.Join(cfg.SnapshotDir, name+".snapshot")
+	}
+
+	return &store{
+		domain:  domain,
+		repo:    repo,
+		cache:   newEntityCache(cfg.CacheSize),
+		cfg:     cfg,
+		shard:   shard,
+		flusher: newFlusher(repo, domain, cfg.Name, strconv.Itoa(shard.Index)),
+		walDir:  walDir,
+
+		// at most one commit and one flush are in flight
+		completionChan: make(chan Completion, 2),
+
+		snapshotPath: snapshotPath,
+		snapshotSem:  make(chan struct{}, 1),
+	}
+}
+
+// Init restores the snapshot then replays the WAL before processing any commands
+func (s *store) Init(ctx context.Context) error {
+	if s.initialized {
+		return nil
+	}
+
+	err := s.restoreSnapshot()
+	if err != nil {
+		return err
+	}
+
+	err = s.openWAL(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.initialized = true
+	return nil
+}
+
+func (s *store) restoreSnapshot() error {
+	if s.snapshotPath == "" {
+		return nil
+	}
+
+	snap, existed, err := readSnapshotFile(s.snapshotPath, s.domain)
+	if err != nil {
+		// entities are loaded from the database instead
+		fmt.Println("Discard snapshot:", err)
+		removeErr := os.Remove(s.snapshotPath)
+		if removeErr != nil {
+			fmt.Println("Remove snapshot:", removeErr)
+		}
+		return nil
+	}
+	if !existed {
+		return nil
+	}
+
+	for _, e := range snap.entities {
+		s.cache.put(e)
+	}
+	s.cache.evict()
+
+	s.epoch = snap.epoch
+	s.ownedRanges = s.shard.OwnedRanges(snap.nodes)
+	s.restored = true
+
+	fmt.Println("Snapshot restored", len(snap.entities), "entities at epoch", snap.epoch)
+	return nil
+}
+
+// takeSnapshot encodes the state, the file is written in background if async is true
+func (s *store) takeSnapshot(async bool) {
+	if s.snapshotPath == "" {
+		return
+	}
+
+	select {
+	case s.snapshotSem <- struct{}{}:
+	default:
+		if async {
+			// the previous one is still being written
+			return
+		}
+		s.snapshotSem <- struct{}{}
+	}
+
+	entities := make([]Entity, 0, s.cache.len())
+	s.cache.forEach(func(e Entity) {
+		entities = append(entities, e)
+	})
+
+	data := encodeSnapshot(snapshot{
+		epoch:    s.epoch,
+		savedAt:  time.Now(),
+		nodes:    s.nodes,
+		entities: entities,
+	}, s.domain)
+
+	write := func() {
+		defer func() { <-s.snapshotSem }()
+
+		err := writeSnapshotFile(s.snapshotPath, data)
+		if err != nil {
+			fmt.Println("Write snapshot:", err)
+		}
+	}
+
+	if async {
+		go write()
+		return
+	}
+	write()
+}
+
+// openWAL replays the WAL into the pending map
+func (s *store) openWAL(ctx context.Context) error {
+	if s.walDir == "" || !s.cfg.WriteBehind {
+		return nil
+	}
+
+	w, entries, err := openWAL(s.walDir, s.domain)
+	if err != nil {
+		return err
+	}
+
+	err = s.flusher.recover(ctx, entries)
+	if err != nil {
+		_ = w.close()
+		return err
+	}
+	if len(s.flusher.pending) == 0 {
+		err := w.removeUntil(w.segment)
+		if err != nil {
+			_ = w.close()
+			return err
+		}
+	}
+
+	s.flusher.wal = w
+	return nil
+}
+
+// Timers ...
+func (s *store) Timers() []Timer {
+	timers := []Timer{
+		{
+			Interval: s.cfg.ExpireInterval,
+			Fn: func() error {
+				return s.expire(time.Now())
+			},
+		},
+	}
+
+	if s.cfg.WriteBehind {
+		timers = append(timers, Timer{
+			Interval: s.cfg.FlushInterval,
+			Fn: func() error {
+				s.flusher.startFlush(s.completeFlush)
+				return nil
+			},
+		})
+	}
+
+	if s.snapshotPath != "" {
+		timers = append(timers, Timer{
+			Interval: s.cfg.SnapshotInterval,
+			Fn: func() error {
+				_, err := s.waitCommit()
+				if err != nil {
+					return err
+				}
+				s.takeSnapshot(true)
+				return nil
+			},
+		})
+	}
+	return timers
+}
+
+// Completions ...
+func (s *store) Completions() <-chan Completion {
+	return s.completionChan
+}
+
+// Apply ...
+func (s *store) Apply(reqs []*Request) error {
+	return s.processCommands(s.skipNotOwnedRequests(reqs), false)
+}
+
+func (s *store) isOwner(key Key) bool {
+	nullNodeID := core.GetNodeID(s.nodes, s.domain.Hash(key))
+	return nullNodeID.Valid && nullNodeID.NodeID == s.shard.NodeID
+}
+
+// skipNotOwnedRequests replies ErrNotOwner to requests of entities owned by other nodes,
+// returns the remaining ones
+func (s *store) skipNotOwnedRequests(reqs []*Request) []*Request {
+	result := reqs[:0]
+	for _, r := range reqs {
+		if !s.isOwner(r.Command.Key()) {
+			r.Fail(ErrNotOwner)
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// findConflicts returns entities changed by others nodes, based on the versions of
+// the aborted batch and the entities in database
+func findConflicts(domain Domain, res applyResult, entities []Entity) map[Key]Entity {
+	dbEntities := make(map[Key]Entity, len(entities))
+	for _, e := range entities {
+		dbEntities[e.EntityKey()] = e
+	}
+
+	conflicts := make(map[Key]Entity)
+	for key, e := range res.updates {
+		dbEntity, existed := dbEntities[key]
+		// an upsert of a not existed entity is an insert
+		if existed && dbEntity.EntityVersion() != e.EntityVersion() {
+			conflicts[key] = dbEntity
+		}
+	}
+	for key, version := range res.deletes {
+		if version == 0 {
+			continue
+		}
+		dbEntity, existed := dbEntities[key]
+		if !existed {
+			conflicts[key] = domain.NewEntity(key, 0)
+			continue
+		}
+		if dbEntity.EntityVersion() != version {
+			conflicts[key] = dbEntity
+		}
+	}
+	return conflicts
+}
+
+// abortConflictedCommands replies ErrCommandAborted to commands of conflicted entities,
+// returns the remaining ones
+func abortConflictedCommands(reqs []*Request, conflicts map[Key]Entity) []*Request {
+	result := make([]*Request, 0, len(reqs))
+	for _, req := range reqs {
+		if _, conflicted := conflicts[req.Command.Key()]; conflicted {
+			req.Fail(ErrCommandAborted)
+			continue
+		}
+		result = append(result, req)
+	}
+	return result
+}
+
+func abortCommit(c *commit) {
+	for _, req := range c.reqs {
+		req.Fail(ErrCommandAborted)
+	}
+}
+
+// resolveConflicts reloads entities of the aborted commit, replies ErrCommandAborted only to
+// commands of entities changed by other nodes, then retries the remaining ones once.
+// All commands of a retry conflicting again are aborted
+func (s *store) resolveConflicts(c *commit) error {
+	ctx := context.Background()
+
+	keys := make([]Key, 0, len(c.res.updates)+len(c.res.deletes))
+	for key := range c.res.updates {
+		keys = append(keys, key)
+	}
+	for key := range c.res.deletes {
+		keys = append(keys, key)
+	}
+
+	if c.retried {
+		// reloads changed entities in later batches
+		for _, key := range keys {
+			s.cache.delete(key)
+		}
+		abortCommit(c)
+		return nil
+	}
+
+	entities, err := s.repo.Get(ctx, keys)
+	if err != nil {
+		fmt.Println("Resolve conflicts:", err)
+		// reloads changed entities in later batches
+		for _, key := range keys {
+			s.cache.delete(key)
+		}
+		abortCommit(c)
+		return nil
+	}
+
+	conflicts := findConflicts(s.domain, c.res, entities)
+	if len(conflicts) == 0 {
+		// retrying the same commands would conflict again
+		for _, key := range keys {
+			s.cache.delete(key)
+		}
+		abortCommit(c)
+		return nil
+	}
+
+	for _, fresh := range conflicts {
+		s.cache.put(fresh)
+	}
+	s.cache.evict()
+
+	reqs := SkipAbortedRequests(c.reqs)
+	reqs = abortConflictedCommands(reqs, conflicts)
+
+	var expired []Key
+	if c.expiring {
+		expired = s.collectExpired(c.now)
+	}
+	if len(reqs) == 0 && len(expired) == 0 {
+		return nil
+	}
+
+	entityMap, res, err := s.applyCommands(ctx, reqs, expired, c.now)
+	if err != nil {
+		return err
+	}
+
+	s.startCommit(&commit{
+		entities: entityMap,
+		res:      res,
+		reqs:     reqs,
+		expiring: c.expiring,
+		now:      c.now,
+		retried:  true,
+	})
+	return nil
+}
+
+// Stop persists unflushed entities before returning err
+func (s *store) Stop(err error) error {
+	_, commitErr := s.waitCommit()
+	if commitErr != nil {
+		return commitErr
+	}
+
+	if s.cfg.WriteBehind {
+		flushErr := s.flushAll()
+		if flushErr != nil {
+			return flushErr
+		}
+	}
+	if s.initialized && s.nodes != nil {
+		s.takeSnapshot(false)
+	}
+	return err
+}
+
+type applyResult struct {
+	// updates keeps new states of entities, versions are increased after persisted
+	updates map[Key]Entity
+	// deletes keeps versions of deleted entities
+	deletes map[Key]uint32
+	// events are replies of commands, in the same order
+	events []Event
+}
+
+// expire deletes expired entities only when the cache has any or the sweep of
+// the database is due, idle shards do not query the database on every tick
+func (s *store) expire(now time.Time) error {
+	if !s.cache.hasExpired(now) && now.Sub(s.lastSweep) < s.cfg.ExpireSweepInterval {
+		return nil
+	}
+	// expired rows are also swept by the same transaction
+	s.lastSweep = now
+	return s.processCommands(nil, true)
+}
+
+// collectExpired returns expired entities owned by the node, others are expired by their owners
+func (s *store) collectExpired(now time.Time) []Key {
+	var result []Key
+	s.cache.forEachExpired(now, func(e Entity) bool {
+		key := e.EntityKey()
+		if s.isOwner(key) {
+			result = append(result, key)
+		}
+		return len(result) < expireBatchSize
+	})
+	return result
+}
+
+// getEntity returns unflushed entities before cached ones
+func (s *store) getEntity(key Key) (Entity, bool) {
+	p, ok := s.flusher.get(key)
+	if ok {
+		return p.entity, true
+	}
+	e, ok := s.getInFlight(key)
+	if ok {
+		return e, true
+	}
+	return s.cache.get(key)
+}
+
+// loadEntities returns entities used by the batch, cache misses are loaded by one query
+func (s *store) loadEntities(ctx context.Context, reqs []*Request, expired []Key) (map[Key]Entity, error) {
+	entityMap := make(map[Key]Entity)
+
+	for _, key := range expired {
+		e, _ := s.getEntity(key)
+		entityMap[key] = e
+	}
+
+	var misses []Key
+	for _, req := range reqs {
+		key := req.Command.Key()
+		if _, existed := entityMap[key]; existed {
+			continue
+		}
+
+		e, ok := s.getEntity(key)
+		if !ok {
+			misses = append(misses, key)
+			// keeps not existed entities in cache
+			e = s.domain.NewEntity(key, 0)
+		}
+		entityMap[key] = e
+	}
+
+	entities, err := s.repo.Get(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entities {
+		entityMap[e.EntityKey()] = e
+	}
+	return entityMap, nil
+}
+
+// storeEntities writes back entities of the batch into the cache
+func (s *store) storeEntities(entityMap map[Key]Entity, deletes map[Key]uint32) {
+	for key := range deletes {
+		s.cache.delete(key)
+	}
+	for _, e := range entityMap {
+		s.cache.put(e)
+	}
+	s.cache.evict()
+}
+
+func replyRequests(reqs []*Request, events []Event) {
+	for i, req := range reqs {
+		req.Reply(events[i])
+	}
+}
+
+func closeRequests(reqs []*Request) {
+	for _, req := range reqs {
+		req.Close()
+	}
+}
+
+func (s *store) processCommands(reqs []*Request, expiring bool) error {
+	now := time.Now()
+
+	var expired []Key
+	if expiring {
+		expired = s.collectExpired(now)
+	}
+	if len(reqs) == 0 && !expiring {
+		return nil
+	}
+
+	ctx := context.Background()
+
+	entityMap, res, err := s.applyCommands(ctx, reqs, expired, now)
+	if err != nil {
+		return err
+	}
+
+	if s.cfg.WriteBehind {
+		if s.flusher.wal != nil {
+			err := s.flusher.wal.append(res)
+			if err != nil {
+				closeRequests(reqs)
+				return err
+			}
+		}
+
+		s.flusher.add(res)
+		s.storeEntities(entityMap, res.deletes)
+		if expiring {
+			s.flusher.scheduleExpire(s.ownedRanges, now)
+		}
+
+		replyRequests(reqs, res.events)
+		return nil
+	}
+
+	if s.inFlight != nil {
+		aborted, err := s.waitCommit()
+		if err != nil {
+			closeRequests(reqs)
+			return err
+		}
+
+		if aborted {
+			// the batch was applied against the discarded results of the aborted one
+			if expiring {
+				expired = s.collectExpired(now)
+			}
+			entityMap, res, err = s.applyCommands(ctx, reqs, expired, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	s.startCommit(&commit{
+		entities: entityMap,
+		res:      res,
+		reqs:     reqs,
+		expiring: expiring,
+		now:      now,
+	})
+	return nil
+}
+
+// applyCommands loads entities and applies commands in memory, closes all requests if error
+func (s *store) applyCommands(ctx context.Context, reqs []*Request, expired []Key, now time.Time,
+) (map[Key]Entity, applyResult, error) {
+	entityMap, err := s.loadEntities(ctx, reqs, expired)
+	if err != nil {
+		closeRequests(reqs)
+		return nil, applyResult{}, err
+	}
+
+	cmds := make([]Command, 0, len(reqs))
+	for _, req := range reqs {
+		cmds = append(cmds, req.Command)
+	}
+
+	state := NewState(now, s.domain.NewEntity, entityMap)
+	for _, key := range expired {
+		state.Delete(key)
+	}
+	events := s.domain.Apply(state, cmds)
+
+	return entityMap, applyResult{
+		updates: state.Updates(),
+		deletes: state.Deletes(),
+		events:  events,
+	}, nil
+}
+
+// commit is a batch being persisted, the next batch is applied against its results
+// which are moved into the cache only after the commit succeeded
+type commit struct {
+	// entities keeps entities of the batch with versions increased
+	entities map[Key]Entity
+	res      applyResult
+
+	// for re-applying the batch after conflicts
+	reqs     []*Request
+	expiring bool
+	now      time.Time
+	// retried is true for the retry of an aborted commit, it is not retried again
+	retried bool
+}
+
+// getInFlight returns the entity changed by the in-flight commit
+func (s *store) getInFlight(key Key) (Entity, bool) {
+	if s.inFlight == nil {
+		return nil, false
+	}
+	if _, deleted := s.inFlight.res.deletes[key]; deleted {
+		return s.domain.NewEntity(key, 0), true
+	}
+	e, ok := s.inFlight.entities[key]
+	return e, ok
+}
+
+// startCommit persists the batch in background
+func (s *store) startCommit(c *commit) {
+	upserts := make([]Entity, 0, len(c.res.updates))
+	for _, e := range c.res.updates {
+		upserts = append(upserts, e)
+	}
+	deletes := make([]Deletion, 0, len(c.res.deletes))
+	for key, version := range c.res.deletes {
+		deletes = append(deletes, Deletion{Key: key, Version: version})
+	}
+	ownedRanges := s.ownedRanges
+	expiring := c.expiring
+	now := c.now
+
+	for key, e := range c.res.updates {
+		c.entities[key] = e.WithEntityVersion(e.EntityVersion() + 1)
+	}
+
+	// the requests are kept for re-applying, the batch slice is reused by the caller
+	c.reqs = append([]*Request(nil), c.reqs...)
+	s.inFlight = c
+
+	go func() {
+		ctx := context.Background()
+		txErr := s.repo.Transact(ctx, func(ctx context.Context, tx TxRepository) error {
+			err := tx.Delete(ctx, deletes)
+			if err != nil {
+				return err
+			}
+
+			if expiring {
+				// for expired entities not in the cache
+				err := tx.DeleteExpired(ctx, ownedRanges, now, expireBatchSize)
+				if err != nil {
+					return err
+				}
+			}
+
+			return tx.Upsert(ctx, upserts)
+		})
+
+		s.completionChan <- func() error {
+			_, err := s.handleCommitResult(txErr)
+			return err
+		}
+	}()
+}
+
+// waitCommit waits until no commit is in flight,
+// returns true if the results of any commit were different from the speculative state
+func (s *store) waitCommit() (bool, error) {
+	aborts := s.commitAborts
+	for s.inFlight != nil {
+		err := s.runCompletion()
+		if err != nil {
+			return s.commitAborts != aborts, err
+		}
+	}
+	return s.commitAborts != aborts, nil
+}
+
+// runCompletion waits for the result of any background work
+func (s *store) runCompletion() error {
+	fn := <-s.completionChan
+	return fn()
+}
+
+// handleCommitResult replies to commands of the in-flight commit, closes all channels if error,
+// returns true if the commit was aborted, it may be retried as a new in-flight commit
+func (s *store) handleCommitResult(err error) (bool, error) {
+	c := s.inFlight
+	s.inFlight = nil
+
+	if err == ErrCommandAborted {
+		s.commitAborts++
+		return true, s.resolveConflicts(c)
+	}
+	if err != nil {
+		closeRequests(c.reqs)
+		return false, err
+	}
+
+	s.storeEntities(c.entities, c.res.deletes)
+
+	replyRequests(c.reqs, c.res.events)
+	return false, nil
+}
+
+// HandleWatch persists entities of lost ranges and warms up the cache for gained ranges
+func (s *store) HandleWatch(wr core.WatchResponse) error {
+	nodes := wr.Nodes
+
+	_, err := s.waitCommit()
+	if err != nil {
+		return err
+	}
+
+	if s.cfg.WriteBehind {
+		// entities of lost ranges must be persisted before other nodes loading them
+		err := s.flushAll()
+		if err != nil {
+			return err
+		}
+		// expired rows of lost ranges are deleted by their new owners
+		s.flusher.cancelExpire()
+	}
+
+	hasSelf := false
+	for _, n := range nodes {
+		if n.NodeID == s.shard.NodeID {
+			hasSelf = true
+		}
+	}
+	if !hasSelf {
+		return ErrShardingConfig
+	}
+
+	ownedRanges := s.shard.OwnedRanges(nodes)
+	gainedRanges := core.SubtractRanges(ownedRanges, s.ownedRanges)
+
+	// entities of lost ranges can be changed by other nodes
+	s.cache.forEach(func(e Entity) {
+		key := e.EntityKey()
+		if !core.RangesContain(ownedRanges, s.domain.Hash(key)) {
+			s.cache.delete(key)
+		}
+	})
+
+	if s.restored {
+		// entities restored from the snapshot can be changed or deleted by other nodes after it was taken
+		err := s.reconcileCache(context.Background())
+		if err != nil {
+			return err
+		}
+		s.restored = false
+	}
+
+	// warms up the cache, other entities are loaded lazily
+	limit := s.cache.capacity - s.cache.len()
+	entities, err := s.repo.GetByHashRanges(context.Background(), gainedRanges, limit)
+	if err != nil {
+		return err
+	}
+	for _, e := range entities {
+		s.cache.put(e)
+	}
+
+	fmt.Println(nodes)
+	s.nodes = nodes
+	s.ownedRanges = ownedRanges
+	s.epoch = wr.Epoch
+	return nil
+}
+
+// reconcileCache replaces cached entities by the persisted ones, drops entities not existed
+func (s *store) reconcileCache(ctx context.Context) error {
+	keys := make([]Key, 0, s.cache.len())
+	s.cache.forEach(func(e Entity) {
+		keys = append(keys, e.EntityKey())
+	})
+
+	for len(keys) > 0 {
+		n := reconcileBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+
+		entities, err := s.repo.Get(ctx, batch)
+		if err != nil {
+			return err
+		}
+
+		existed := make(map[Key]struct{}, len(entities))
+		for _, e := range entities {
+			existed[e.EntityKey()] = struct{}{}
+			s.cache.put(e)
+		}
+		for _, key := range batch {
+			if _, ok := existed[key]; !ok {
+				s.cache.delete(key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,663 @@
+package statemachine
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sharding/core"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEntity struct {
+	key       Key
+	version   uint32
+	value     uint32
+	expiredAt time.Time
+}
+
+func (e testEntity) EntityKey() Key {
+	return e.key
+}
+
+func (e testEntity) EntityVersion() uint32 {
+	return e.version
+}
+
+func (e testEntity) EntityExpiredAt() time.Time {
+	return e.expiredAt
+}
+
+func (e testEntity) WithEntityVersion(version uint32) Entity {
+	e.version = version
+	return e
+}
+
+// testIncrease increases the value of the entity, replies the new value
+type testIncrease struct {
+	key Key
+}
+
+func (c testIncrease) Hash() core.Hash {
+	return core.Hash(c.key)
+}
+
+func (c testIncrease) Key() Key {
+	return c.key
+}
+
+type testDomain struct{}
+
+func (testDomain) Hash(key Key) core.Hash {
+	return core.Hash(key)
+}
+
+func (testDomain) NewEntity(key Key, version uint32) Entity {
+	return testEntity{key: key, version: version}
+}
+
+func (testDomain) Apply(state *State, cmds []Command) []Event {
+	events := make([]Event, 0, len(cmds))
+	for _, cmd := range cmds {
+		e := state.Get(cmd.Key()).(testEntity)
+		e.value++
+		state.Put(e)
+		events = append(events, e.value)
+	}
+	return events
+}
+
+func (testDomain) EncodeEntity(e *Encoder, entity Entity) {
+	te := entity.(testEntity)
+	e.Uint64(uint64(te.key))
+	e.Uint32(te.version)
+	e.Uint32(te.value)
+	e.Time(te.expiredAt)
+}
+
+func (testDomain) DecodeEntity(d *Decoder) Entity {
+	return testEntity{
+		key:       Key(d.Uint64()),
+		version:   d.Uint32(),
+		value:     d.Uint32(),
+		expiredAt: d.Time(),
+	}
+}
+
+func (testDomain) EntitySize(entity Entity) int {
+	return 20
+}
+
+type fakeRepo struct {
+	Repository
+	entities []Entity
+	txErr    error
+	// tx is called by Transact if not nil
+	tx *fakeTx
+	// loadedRanges are the ranges of every call of GetByHashRanges
+	loadedRanges [][]core.HashRange
+	// loadedKeys are the keys of every call of Get
+	loadedKeys [][]Key
+}
+
+type fakeTx struct {
+	TxRepository
+	expiredRanges []core.HashRange
+	// upsertErrs are returned by the next calls of Upsert
+	upsertErrs []error
+	// upserted are the entities of every succeeded call of Upsert
+	upserted [][]Entity
+}
+
+func (tx *fakeTx) Delete(ctx context.Context, deletes []Deletion) error {
+	return nil
+}
+
+func (tx *fakeTx) DeleteExpired(ctx context.Context, ranges []core.HashRange, now time.Time, limit int) error {
+	tx.expiredRanges = ranges
+	return nil
+}
+
+func (tx *fakeTx) Upsert(ctx context.Context, entities []Entity) error {
+	if len(tx.upsertErrs) > 0 {
+		err := tx.upsertErrs[0]
+		tx.upsertErrs = tx.upsertErrs[1:]
+		return err
+	}
+	tx.upserted = append(tx.upserted, entities)
+	return nil
+}
+
+// GetByHashRanges returns entities in the ranges, the hashes of entities are their keys
+func (r *fakeRepo) GetByHashRanges(ctx context.Context, ranges []core.HashRange, limit int) ([]Entity, error) {
+	r.loadedRanges = append(r.loadedRanges, ranges)
+
+	var result []Entity
+	for _, e := range r.entities {
+		if core.RangesContain(ranges, core.Hash(e.EntityKey())) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+func (r *fakeRepo) Get(ctx context.Context, keys []Key) ([]Entity, error) {
+	r.loadedKeys = append(r.loadedKeys, keys)
+	return r.entities, nil
+}
+
+func (r *fakeRepo) Transact(ctx context.Context, fn func(ctx context.Context, tx TxRepository) error) error {
+	if r.tx != nil {
+		return fn(ctx, r.tx)
+	}
+	return r.txErr
+}
+
+func newTestStore(cfg StoreConfig, repo Repository) *store {
+	cfg.CacheSize = 10
+	shard := Shard{NodeID: 1, Index: 0, Count: 1}
+	return NewStore(shard, cfg, testDomain{}, repo).(*store)
+}
+
+func TestStore_InFlightCommit(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("committed", func(t *testing.T) {
+		s := newTestStore(StoreConfig{}, nil)
+		s.cache.put(testEntity{key: 10, version: 3, value: 7})
+		s.cache.put(testEntity{key: 11, version: 2, value: 1})
+
+		req := NewRequest(ctx, testIncrease{key: 10})
+		s.inFlight = &commit{
+			entities: map[Key]Entity{
+				10: testEntity{key: 10, version: 4, value: 8},
+			},
+			res: applyResult{
+				updates: map[Key]Entity{
+					10: testEntity{key: 10, version: 3, value: 8},
+				},
+				deletes: map[Key]uint32{11: 2},
+				events:  []Event{uint32(8)},
+			},
+			reqs: []*Request{req},
+		}
+
+		e, _ := s.getEntity(10)
+		assert.Equal(t, testEntity{key: 10, version: 4, value: 8}, e)
+		e, _ = s.getEntity(11)
+		assert.Equal(t, testEntity{key: 11}, e)
+
+		aborted, err := s.handleCommitResult(nil)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, false, aborted)
+
+		ev, err := req.Wait(ctx)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint32(8), ev)
+
+		e, _ = s.cache.get(10)
+		assert.Equal(t, testEntity{key: 10, version: 4, value: 8}, e)
+		_, ok := s.cache.get(11)
+		assert.Equal(t, false, ok)
+	})
+
+	// entity 10 was changed by another node, entity 12 was not
+	newConflictedStore := func(txErr error) (*store, *Request, *Request) {
+		repo := &fakeRepo{
+			entities: []Entity{
+				testEntity{key: 10, version: 5, value: 20},
+				testEntity{key: 12, version: 1, value: 3},
+			},
+			txErr: txErr,
+		}
+		s := newTestStore(StoreConfig{}, repo)
+		s.nodes = []core.NodeInfo{{NodeID: 1, Hash: math.MaxUint32}}
+		s.cache.put(testEntity{key: 10, version: 3, value: 7})
+		s.cache.put(testEntity{key: 12, version: 1, value: 3})
+
+		conflicted := NewRequest(ctx, testIncrease{key: 10})
+		other := NewRequest(ctx, testIncrease{key: 12})
+		s.inFlight = &commit{
+			entities: map[Key]Entity{
+				10: testEntity{key: 10, version: 4, value: 8},
+				12: testEntity{key: 12, version: 2, value: 4},
+			},
+			res: applyResult{
+				updates: map[Key]Entity{
+					10: testEntity{key: 10, version: 3, value: 8},
+					12: testEntity{key: 12, version: 1, value: 4},
+				},
+				events: []Event{uint32(8), uint32(4)},
+			},
+			reqs: []*Request{conflicted, other},
+		}
+		return s, conflicted, other
+	}
+
+	t.Run("conflicted", func(t *testing.T) {
+		s, conflicted, other := newConflictedStore(nil)
+
+		aborted, err := s.handleCommitResult(ErrCommandAborted)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, aborted)
+
+		_, err = conflicted.Wait(ctx)
+		assert.Equal(t, ErrCommandAborted, err)
+
+		// retried without the conflicted command
+		_, err = s.waitCommit()
+		assert.Equal(t, nil, err)
+
+		ev, err := other.Wait(ctx)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint32(4), ev)
+
+		e, _ := s.cache.get(10)
+		assert.Equal(t, testEntity{key: 10, version: 5, value: 20}, e)
+		e, _ = s.cache.get(12)
+		assert.Equal(t, testEntity{key: 12, version: 2, value: 4}, e)
+	})
+
+	t.Run("conflicted-again", func(t *testing.T) {
+		s, conflicted, other := newConflictedStore(ErrCommandAborted)
+
+		aborted, err := s.handleCommitResult(ErrCommandAborted)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, aborted)
+
+		_, err = conflicted.Wait(ctx)
+		assert.Equal(t, ErrCommandAborted, err)
+
+		// the retry is not retried again
+		aborted, err = s.waitCommit()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, aborted)
+		assert.Equal(t, (*commit)(nil), s.inFlight)
+
+		_, err = other.Wait(ctx)
+		assert.Equal(t, ErrCommandAborted, err)
+
+		_, ok := s.cache.get(12)
+		assert.Equal(t, false, ok)
+	})
+}
+
+func TestFindConflicts(t *testing.T) {
+	res := applyResult{
+		updates: map[Key]Entity{
+			10: testEntity{key: 10, version: 3},
+			11: testEntity{key: 11, version: 1},
+			12: testEntity{key: 12, version: 2},
+		},
+		deletes: map[Key]uint32{13: 4, 14: 0, 15: 1},
+	}
+
+	conflicts := findConflicts(testDomain{}, res, []Entity{
+		testEntity{key: 10, version: 3},
+		testEntity{key: 11, version: 2, value: 5},
+		testEntity{key: 15, version: 1},
+	})
+	assert.Equal(t, map[Key]Entity{
+		11: testEntity{key: 11, version: 2, value: 5},
+		13: testEntity{key: 13},
+	}, conflicts)
+}
+
+func TestStore_CollectExpired(t *testing.T) {
+	now := time.Now()
+
+	s := newTestStore(StoreConfig{}, nil)
+	s.cache.put(testEntity{key: 10, value: 1, expiredAt: now.Add(-time.Second)})
+	s.cache.put(testEntity{key: 11, value: 1, expiredAt: now.Add(time.Second)})
+	s.cache.put(testEntity{key: 12, value: 1})
+
+	// owned by another node
+	s.nodes = []core.NodeInfo{{NodeID: 2, Hash: math.MaxUint32}}
+	assert.Equal(t, []Key(nil), s.collectExpired(now))
+
+	s.nodes = []core.NodeInfo{{NodeID: 1, Hash: math.MaxUint32}}
+	assert.Equal(t, []Key{10}, s.collectExpired(now))
+}
+
+func TestStore_Expire(t *testing.T) {
+	now := time.Now()
+
+	table := []struct {
+		name      string
+		expiredAt time.Time
+		lastSweep time.Time
+		// true if a commit was started
+		expired bool
+	}{
+		{
+			name:      "idle",
+			lastSweep: now.Add(-time.Second),
+		},
+		{
+			name:      "not-expired",
+			expiredAt: now.Add(time.Second),
+			lastSweep: now.Add(-time.Second),
+		},
+		{
+			name:      "expired",
+			expiredAt: now.Add(-time.Second),
+			lastSweep: now.Add(-time.Second),
+			expired:   true,
+		},
+		{
+			name:      "sweep",
+			lastSweep: now.Add(-time.Hour),
+			expired:   true,
+		},
+	}
+
+	for _, e := range table {
+		t.Run(e.name, func(t *testing.T) {
+			tx := &fakeTx{}
+			s := newTestStore(StoreConfig{ExpireSweepInterval: time.Minute}, &fakeRepo{tx: tx})
+			s.nodes = []core.NodeInfo{{NodeID: 1, Hash: math.MaxUint32}}
+			s.ownedRanges = s.shard.OwnedRanges(s.nodes)
+			s.lastSweep = e.lastSweep
+			s.cache.put(testEntity{key: 10, value: 1, expiredAt: e.expiredAt})
+
+			err := s.expire(now)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, e.expired, s.inFlight != nil)
+
+			_, err = s.waitCommit()
+			assert.Equal(t, nil, err)
+			if e.expired {
+				assert.Equal(t, now, s.lastSweep)
+				assert.Equal(t, s.ownedRanges, tx.expiredRanges)
+			} else {
+				assert.Equal(t, []core.HashRange(nil), tx.expiredRanges)
+			}
+		})
+	}
+}
+
+func TestStore_WriteBehindExpire(t *testing.T) {
+	tx := &fakeTx{}
+	s := newTestStore(StoreConfig{WriteBehind: true}, &fakeRepo{tx: tx})
+	s.nodes = []core.NodeInfo{{NodeID: 1, Hash: math.MaxUint32}}
+	s.ownedRanges = s.shard.OwnedRanges(s.nodes)
+
+	err := s.processCommands(nil, true)
+	assert.Equal(t, nil, err)
+
+	// expired rows not in the cache are deleted by the flush even if nothing is pending
+	s.flusher.startFlush(s.completeFlush)
+	assert.Equal(t, true, s.flusher.inFlight)
+
+	err = s.runCompletion()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, s.flusher.inFlight)
+	assert.Equal(t, s.ownedRanges, tx.expiredRanges)
+}
+
+func TestStore_FlushConflicted(t *testing.T) {
+	// entity 10 was changed by another node, entity 11 was not
+	tx := &fakeTx{upsertErrs: []error{ErrCommandAborted}}
+	repo := &fakeRepo{
+		entities: []Entity{
+			testEntity{key: 10, version: 5, value: 20},
+			testEntity{key: 11, version: 1, value: 3},
+		},
+		tx: tx,
+	}
+	s := newTestStore(StoreConfig{WriteBehind: true, Name: "flush-conflicted"}, repo)
+
+	dir, err := ioutil.TempDir("", "wal")
+	assert.Equal(t, nil, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	w, _, err := openWAL(dir, testDomain{})
+	assert.Equal(t, nil, err)
+	defer func() { _ = w.close() }()
+	s.flusher.wal = w
+
+	res := applyResult{
+		updates: map[Key]Entity{
+			10: testEntity{key: 10, version: 3, value: 8},
+			11: testEntity{key: 11, version: 1, value: 4},
+		},
+	}
+	assert.Equal(t, nil, w.append(res))
+	s.flusher.add(res)
+
+	dropped := droppedEntities.WithLabelValues("flush-conflicted", "0")
+	droppedBefore := testutil.ToFloat64(dropped)
+
+	s.flusher.startFlush(s.completeFlush)
+	err = s.runCompletion()
+	assert.Equal(t, nil, err)
+
+	// retried without the conflicted entity, the logged changes are kept until then
+	assert.Equal(t, true, s.flusher.inFlight)
+	segments, err := listWALSegments(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(segments))
+
+	err = s.runCompletion()
+	assert.Equal(t, nil, err)
+
+	segments, err = listWALSegments(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(segments))
+
+	assert.Equal(t, [][]Entity{{testEntity{key: 11, version: 1, value: 4}}}, tx.upserted)
+	assert.Equal(t, 0, len(s.flusher.pending))
+	assert.Equal(t, nil, s.flusher.lastErr)
+
+	e, _ := s.cache.get(10)
+	assert.Equal(t, testEntity{key: 10, version: 5, value: 20}, e)
+	assert.Equal(t, droppedBefore+1, testutil.ToFloat64(dropped))
+}
+
+func TestStore_RecoverWAL(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "wal")
+	assert.Equal(t, nil, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	w, _, err := openWAL(filepath.Join(dir, "node-1"), testDomain{})
+	assert.Equal(t, nil, err)
+	err = w.append(applyResult{
+		updates: map[Key]Entity{
+			10: testEntity{key: 10, version: 3, value: 8},
+			11: testEntity{key: 11, version: 2, value: 4},
+			13: testEntity{key: 13, value: 1},
+		},
+		deletes: map[Key]uint32{12: 4},
+	})
+	assert.Equal(t, nil, err)
+	// the latest change of a key is replayed
+	err = w.append(applyResult{
+		updates: map[Key]Entity{
+			10: testEntity{key: 10, version: 3, value: 9},
+		},
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, w.close())
+
+	// entity 11 was persisted, entities 10 and 12 were not, entity 13 was not inserted
+	repo := &fakeRepo{
+		entities: []Entity{
+			testEntity{key: 10, version: 3, value: 7},
+			testEntity{key: 11, version: 3, value: 4},
+			testEntity{key: 12, version: 4, value: 2},
+		},
+	}
+	s := newTestStore(StoreConfig{WriteBehind: true, WALDir: dir}, repo)
+	err = s.Init(ctx)
+	assert.Equal(t, nil, err)
+	defer func() { _ = s.flusher.wal.close() }()
+
+	pending := make(map[Key]pendingEntity)
+	for key, p := range s.flusher.pending {
+		p.seq = 0
+		pending[key] = p
+	}
+	assert.Equal(t, map[Key]pendingEntity{
+		10: {entity: testEntity{key: 10, version: 3, value: 9}},
+		12: {entity: testEntity{key: 12, version: 4}, deleted: true},
+		13: {entity: testEntity{key: 13, value: 1}},
+	}, pending)
+}
+
+func TestStore_RestoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Equal(t, nil, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	t.Run("corrupted", func(t *testing.T) {
+		s := newTestStore(StoreConfig{SnapshotDir: dir}, nil)
+		err := ioutil.WriteFile(s.snapshotPath, []byte("corrupted"), 0644)
+		assert.Equal(t, nil, err)
+
+		// falls back to loading from the database
+		err = s.Init(ctx)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, false, s.restored)
+
+		_, err = os.Stat(s.snapshotPath)
+		assert.Equal(t, true, os.IsNotExist(err))
+	})
+
+	t.Run("reconciled", func(t *testing.T) {
+		// entity 11 was deleted after the snapshot was taken
+		repo := &fakeRepo{
+			entities: []Entity{testEntity{key: 10, version: 5, value: 20}},
+		}
+		s := newTestStore(StoreConfig{SnapshotDir: dir}, repo)
+		s.nodes = []core.NodeInfo{{NodeID: 1, Hash: math.MaxUint32}}
+		s.cache.put(testEntity{key: 10, version: 3, value: 7})
+		s.cache.put(testEntity{key: 11, version: 2, value: 1})
+		s.takeSnapshot(false)
+
+		s = newTestStore(StoreConfig{SnapshotDir: dir}, repo)
+		err := s.Init(ctx)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 2, s.cache.len())
+
+		err = s.HandleWatch(core.WatchResponse{
+			Epoch: 2,
+			Nodes: []core.NodeInfo{{NodeID: 1, Hash: math.MaxUint32}},
+		})
+		assert.Equal(t, nil, err)
+
+		e, _ := s.cache.get(10)
+		assert.Equal(t, testEntity{key: 10, version: 5, value: 20}, e)
+		_, ok := s.cache.get(11)
+		assert.Equal(t, false, ok)
+	})
+}
+
+func TestStore_HandleWatch(t *testing.T) {
+	repo := &fakeRepo{
+		entities: []Entity{
+			testEntity{key: 10, version: 1},
+			testEntity{key: 60, version: 1},
+			testEntity{key: 120, version: 1},
+			testEntity{key: 170, version: 1},
+		},
+	}
+	s := newTestStore(StoreConfig{}, repo)
+
+	err := s.HandleWatch(core.WatchResponse{
+		Epoch: 1,
+		Nodes: []core.NodeInfo{
+			{NodeID: 1, Hash: 100},
+			{NodeID: 2, Hash: 200},
+			{NodeID: 3, Hash: math.MaxUint32},
+		},
+	})
+	assert.Equal(t, nil, err)
+
+	// range (50, 100] is kept, (0, 50] is lost and (100, 150] is gained
+	err = s.HandleWatch(core.WatchResponse{
+		Epoch: 2,
+		Nodes: []core.NodeInfo{
+			{NodeID: 2, Hash: 50},
+			{NodeID: 1, Hash: 150},
+			{NodeID: 3, Hash: math.MaxUint32},
+		},
+	})
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, [][]core.HashRange{
+		{{Begin: 0, End: 100}},
+		{{Begin: 101, End: 150}},
+	}, repo.loadedRanges)
+
+	var keys []Key
+	s.cache.forEach(func(e Entity) {
+		keys = append(keys, e.EntityKey())
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	assert.Equal(t, []Key{60, 120}, keys)
+	assert.Equal(t, uint64(2), s.epoch)
+}
+
+func TestStore_LoadEntities(t *testing.T) {
+	ctx := context.Background()
+
+	// entity 12 is not existed in the database
+	repo := &fakeRepo{
+		entities: []Entity{
+			testEntity{key: 11, version: 2, value: 5},
+		},
+	}
+	s := newTestStore(StoreConfig{}, repo)
+	s.cache.put(testEntity{key: 10, version: 1, value: 3})
+
+	reqs := []*Request{
+		NewRequest(ctx, testIncrease{key: 10}),
+		NewRequest(ctx, testIncrease{key: 11}),
+		NewRequest(ctx, testIncrease{key: 12}),
+		NewRequest(ctx, testIncrease{key: 11}),
+	}
+	entityMap, err := s.loadEntities(ctx, reqs, nil)
+	assert.Equal(t, nil, err)
+
+	// misses of the batch are loaded by one query
+	assert.Equal(t, [][]Key{{11, 12}}, repo.loadedKeys)
+	assert.Equal(t, map[Key]Entity{
+		10: testEntity{key: 10, version: 1, value: 3},
+		11: testEntity{key: 11, version: 2, value: 5},
+		12: testEntity{key: 12},
+	}, entityMap)
+}
+
+func TestStore_ApplyNotOwned(t *testing.T) {
+	ctx := context.Background()
+
+	s := newTestStore(StoreConfig{WriteBehind: true}, &fakeRepo{})
+	// the hashes of entities are their keys
+	s.nodes = []core.NodeInfo{
+		{NodeID: 1, Hash: 100},
+		{NodeID: 2, Hash: 200},
+	}
+
+	owned := NewRequest(ctx, testIncrease{key: 50})
+	notOwned := NewRequest(ctx, testIncrease{key: 150})
+
+	err := s.Apply([]*Request{owned, notOwned})
+	assert.Equal(t, nil, err)
+
+	ev, err := owned.Wait(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint32(1), ev)
+
+	_, err = notOwned.Wait(ctx)
+	assert.Equal(t, ErrNotOwner, err)
+
+	_, ok := s.cache.get(150)
+	assert.Equal(t, false, ok)
+}
@@ -0,0 +1,223 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WAL is a redo log of applied batches, each record keeps new states of changed entities.
+// Records are appended to segments, a segment is removed after all of its entities are persisted.
+//
+// Record format: length (4 bytes) | crc32 of payload (4 bytes) | payload
+// Payload format: number of entries (4 bytes) | entries
+// Entry format: deleted (1 byte) | entity encoded by the domain,
+// a deleted entity is encoded as the new entity with the version of the deleted row
+
+const walHeaderSize = 8
+
+const (
+	walSegmentPrefix = "wal-"
+	walSegmentSuffix = ".log"
+)
+
+type walEntry struct {
+	entity  Entity
+	deleted bool
+}
+
+type wal struct {
+	dir     string
+	domain  Domain
+	segment uint64
+	file    *os.File
+}
+
+func walSegmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d%s", walSegmentPrefix, segment, walSegmentSuffix))
+}
+
+// listWALSegments returns segment numbers in increasing order
+func listWALSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+
+		var segment uint64
+		_, err := fmt.Sscanf(strings.TrimPrefix(name, walSegmentPrefix), "%d", &segment)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+// openWAL reads entries of all existing segments then opens a new segment
+func openWAL(dir string, domain Domain) (*wal, []walEntry, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []walEntry
+	for _, segment := range segments {
+		data, err := ioutil.ReadFile(walSegmentPath(dir, segment))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		segmentEntries, err := decodeWALRecords(data, domain)
+		entries = append(entries, segmentEntries...)
+		if err != nil {
+			// a torn write at the tail, records after it are never replied
+			fmt.Println("WAL segment", segment, "truncated:", err)
+		}
+	}
+
+	w := &wal{dir: dir, domain: domain}
+	if len(segments) > 0 {
+		w.segment = segments[len(segments)-1]
+	}
+
+	err = w.rotate()
+	if err != nil {
+		return nil, nil, err
+	}
+	return w, entries, nil
+}
+
+func decodeWALRecords(data []byte, domain Domain) ([]walEntry, error) {
+	var entries []walEntry
+	for len(data) > 0 {
+		if len(data) < walHeaderSize {
+			return entries, errCorruptedData
+		}
+
+		length := binary.LittleEndian.Uint32(data[0:4])
+		checksum := binary.LittleEndian.Uint32(data[4:8])
+		data = data[walHeaderSize:]
+
+		if uint32(len(data)) < length {
+			return entries, errCorruptedData
+		}
+		payload := data[:length]
+		data = data[length:]
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return entries, errCorruptedData
+		}
+
+		d := &Decoder{buf: payload}
+		n := d.Uint32()
+		for i := uint32(0); i < n && d.err == nil; i++ {
+			deleted := d.Uint8() != 0
+			entries = append(entries, walEntry{
+				deleted: deleted,
+				entity:  domain.DecodeEntity(d),
+			})
+		}
+		if d.err != nil {
+			return entries, d.err
+		}
+	}
+	return entries, nil
+}
+
+func encodeWALRecord(res applyResult, domain Domain) []byte {
+	e := &Encoder{buf: make([]byte, walHeaderSize, 256)}
+	e.Uint32(uint32(len(res.updates) + len(res.deletes)))
+
+	for key, version := range res.deletes {
+		e.Uint8(1)
+		domain.EncodeEntity(e, domain.NewEntity(key, version))
+	}
+	for _, entity := range res.updates {
+		e.Uint8(0)
+		domain.EncodeEntity(e, entity)
+	}
+
+	payload := e.buf[walHeaderSize:]
+	binary.LittleEndian.PutUint32(e.buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(e.buf[4:8], crc32.ChecksumIEEE(payload))
+	return e.buf
+}
+
+// append writes and syncs a record of the batch
+func (w *wal) append(res applyResult) error {
+	if len(res.updates) == 0 && len(res.deletes) == 0 {
+		return nil
+	}
+
+	_, err := w.file.Write(encodeWALRecord(res, w.domain))
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// rotate starts a new segment
+func (w *wal) rotate() error {
+	file, err := os.OpenFile(walSegmentPath(w.dir, w.segment+1),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if w.file != nil {
+		err := w.file.Close()
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+
+	w.file = file
+	w.segment++
+	return nil
+}
+
+// removeUntil removes segments before the segment
+func (w *wal) removeUntil(segment uint64) error {
+	segments, err := listWALSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s >= segment {
+			break
+		}
+		err := os.Remove(walSegmentPath(w.dir, s))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,61 @@
+package statemachine
+
+import (
+	"sharding/core"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWALRecords_RoundTrip(t *testing.T) {
+	entity := testEntity{
+		key:       10,
+		version:   3,
+		value:     7,
+		expiredAt: time.Unix(1600000000, 0),
+	}
+
+	data := encodeWALRecord(applyResult{
+		updates: map[Key]Entity{10: entity},
+	}, testDomain{})
+	data = append(data, encodeWALRecord(applyResult{
+		deletes: map[Key]uint32{11: 5},
+	}, testDomain{})...)
+
+	entries, err := decodeWALRecords(data, testDomain{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []walEntry{
+		{entity: entity},
+		{entity: testEntity{key: 11, version: 5}, deleted: true},
+	}, entries)
+
+	// torn write at the tail
+	entries, err = decodeWALRecords(data[:len(data)-3], testDomain{})
+	assert.Equal(t, errCorruptedData, err)
+	assert.Equal(t, []walEntry{{entity: entity}}, entries)
+}
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	s := snapshot{
+		epoch:   12,
+		savedAt: time.Unix(1600000000, 0),
+		nodes: []core.NodeInfo{
+			{NodeID: 1, Hash: 100, Address: "localhost:5001"},
+			{NodeID: 2, Hash: 200, Address: "localhost:5002"},
+		},
+		entities: []Entity{
+			testEntity{key: 10, version: 3, value: 7},
+			testEntity{key: 11, version: 1, value: 1, expiredAt: time.Unix(1600000060, 0)},
+		},
+	}
+
+	data := encodeSnapshot(s, testDomain{})
+	result, err := decodeSnapshot(data, testDomain{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s, result)
+
+	data[len(data)-1]++
+	_, err = decodeSnapshot(data, testDomain{})
+	assert.Equal(t, errCorruptedData, err)
+}